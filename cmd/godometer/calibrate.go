@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lietu/godometer/monitor"
+)
+
+// Fewer revolutions than this make the result unreliable, one pulse more or less is a big difference
+const minCalibrationRevolutions = 20
+
+func waitForEnter(stdin *bufio.Reader, prompt string) string {
+	fmt.Print(prompt)
+	line, err := stdin.ReadString('\n')
+	if err != nil {
+		log.Fatalf("Could not read input: %s", err)
+	}
+
+	return strings.TrimSpace(line)
+}
+
+func runCalibrate(config Config) {
+	results := make(chan monitor.GPIORecord, 100)
+	stdin := bufio.NewReader(os.Stdin)
+
+	ps := config.pulseSource()
+	wheel := config.newWheel(results)
+	counter := monitor.NewRevolutionCounter(config.pulsesPerRev)
+	wheel.AddObserver(counter.Record)
+
+	// Nothing uses the records, just keep the buffer from filling up
+	go func() {
+		for range results {
+		}
+	}()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	go func() {
+		if err := ps.Monitor(ctx, wheel.Handle); err != nil {
+			log.Fatalf("Could not collect pulses: %s", err)
+		}
+	}()
+
+	distance := config.calibrateDistance
+	if distance > 0 {
+		fmt.Printf("Measure out %.1fm, e.g. with a tape measure, and get ready at the start.\n", distance)
+		waitForEnter(stdin, "Press Enter to start, then walk the distance. ")
+		counter.Reset()
+		waitForEnter(stdin, "Press Enter when you have walked the distance. ")
+	} else {
+		if config.calibrateSpeed <= 0 {
+			log.Fatal("Calibrate needs either a positive -calibrateDistance or -calibrateSpeed")
+		}
+
+		distance = config.calibrateSpeed * 1000.0 / 3600.0 * config.duration.Seconds()
+		fmt.Printf("Set the treadmill to %.1fkm/h and wait until it has reached that speed.\n", config.calibrateSpeed)
+		waitForEnter(stdin, fmt.Sprintf("Press Enter to start measuring for %s. ", config.duration))
+		counter.Reset()
+		time.Sleep(config.duration)
+	}
+
+	stop()
+
+	revolutions := counter.Revolutions()
+	if revolutions == 0 {
+		log.Fatal("No revolutions were detected, check the setup with the diagnose command first")
+	}
+
+	circumference := distance / revolutions
+	change := (circumference - config.wheelCircumference) / config.wheelCircumference * 100.0
+
+	fmt.Println()
+	fmt.Printf("Distance:      %.2fm\n", distance)
+	fmt.Printf("Revolutions:   %.1f\n", revolutions)
+	fmt.Printf("Circumference: %.5fm (currently %.5fm, %+.1f%%)\n", circumference, config.wheelCircumference, change)
+
+	if revolutions < minCalibrationRevolutions {
+		fmt.Printf("Only %.0f revolutions, use a longer distance or duration for an accurate result.\n", revolutions)
+	}
+
+	if math.Abs(change) > 20.0 {
+		fmt.Println("That is a big change, double check the distance or speed before saving.")
+	}
+
+	answer := waitForEnter(stdin, fmt.Sprintf("Save WHEEL_CIRCUMFERENCE to %s? [y/N] ", config.configPath))
+	if answer != "y" && answer != "Y" {
+		fmt.Println("Not saved.")
+		return
+	}
+
+	err := writeConfigValue(config.configPath, "WHEEL_CIRCUMFERENCE", fmt.Sprintf("%.5f", circumference))
+	if err != nil {
+		log.Fatalf("Could not write %s: %s", config.configPath, err)
+	}
+
+	fmt.Printf("Saved to %s\n", config.configPath)
+}
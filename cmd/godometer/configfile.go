@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Environment variables that were set from the config file
+var configFileKeys = map[string]bool{}
+
+// Every flag mentions its environment variable in the usage
+var flagEnvPattern = regexp.MustCompile(`use the ([A-Z0-9_]+) environment variable`)
+
+// The config file uses the same KEY=value format as systemd EnvironmentFile, so
+// it can be shared with godometer.service. The values are only defaults, anything
+// set on the command line or in the real environment takes priority over the file.
+func loadConfigFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	defer func() { _ = file.Close() }()
+
+	// Flags set on the command line, by the environment variables they can be set with
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		if m := flagEnvPattern.FindStringSubmatch(f.Usage); m != nil {
+			setFlags[m[1]] = true
+		}
+	})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, ok := parseConfigLine(scanner.Text())
+		if !ok {
+			continue
+		}
+
+		if _, set := os.LookupEnv(key); !set && !setFlags[key] {
+			_ = os.Setenv(key, value)
+			configFileKeys[key] = true
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Whether a setting was given on the command line or in the environment, instead of
+// coming from the config file or the defaults
+func explicitlySet(flagName string, envName string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == flagName {
+			set = true
+		}
+	})
+
+	if e := os.Getenv(envName); e != "" && !configFileKeys[envName] {
+		set = true
+	}
+
+	return set
+}
+
+func parseConfigLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	key := strings.TrimSpace(parts[0])
+	value := strings.Trim(strings.TrimSpace(parts[1]), `"'`)
+
+	return key, value, true
+}
+
+// Set a value in the config file, keeping everything else as it was
+func writeConfigValue(path string, key string, value string) error {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var lines []string
+	replaced := false
+	if len(contents) > 0 {
+		for _, line := range strings.Split(strings.TrimRight(string(contents), "\n"), "\n") {
+			if k, _, ok := parseConfigLine(line); ok && k == key {
+				line = fmt.Sprintf("%s=%s", key, value)
+				replaced = true
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	if !replaced {
+		lines = append(lines, fmt.Sprintf("%s=%s", key, value))
+	}
+
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/lietu/godometer/monitor"
+)
+
+const histogramWidth = 40
+
+func printDiagnostics(r monitor.DiagnosticsReport) {
+	fmt.Println()
+	fmt.Printf("Signal diagnostics over %s\n", r.Duration.Round(time.Second))
+	fmt.Println()
+	fmt.Printf("Edges seen:           %d\n", r.Edges)
+	fmt.Printf("Accepted:             %d\n", r.Accepted)
+	fmt.Printf("Too fast (flapping):  %d\n", r.TooFast)
+	fmt.Printf("Too slow (pauses):    %d\n", r.TooSlow)
+	fmt.Printf("Same edge repeated:   %d\n", r.SameEdge)
+	fmt.Printf("Implausible speedup:  %d\n", r.Rejected)
+	fmt.Println()
+
+	fmt.Println("Intervals between rising edges:")
+	most := 0
+	for _, b := range r.Intervals {
+		if b.Count > most {
+			most = b.Count
+		}
+	}
+
+	for _, b := range r.Intervals {
+		bar := 0
+		if most > 0 {
+			bar = b.Count * histogramWidth / most
+		}
+
+		fmt.Printf("  %-16s %6d %s\n", b.Label, b.Count, strings.Repeat("#", bar))
+	}
+
+	fmt.Println()
+	fmt.Printf("Estimated noise level: %.1f%%\n", r.NoiseLevel*100.0)
+	fmt.Printf("Verdict: %s\n", r.Verdict)
+	for _, hint := range r.Hints {
+		fmt.Printf(" - %s\n", hint)
+	}
+}
+
+func runDiagnose(config Config) {
+	results := make(chan monitor.GPIORecord, 100)
+
+	ps := config.pulseSource()
+	wheel := config.newWheel(results)
+	diagnostics := monitor.NewDiagnostics()
+	wheel.AddObserver(diagnostics.Record)
+
+	// Nothing uses the records, just keep the buffer from filling up
+	go func() {
+		for range results {
+		}
+	}()
+
+	ctx, stop := context.WithTimeout(context.Background(), config.duration)
+	defer stop()
+
+	log.Printf("Turn the wheel steadily, collecting pulses for %s", config.duration)
+
+	// Also stops once a replay has finished
+	if err := ps.Monitor(ctx, wheel.Handle); err != nil {
+		log.Fatalf("Could not collect pulses: %s", err)
+	}
+
+	printDiagnostics(diagnostics.Report())
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/lietu/godometer/monitor"
@@ -17,36 +21,221 @@ var (
 	dev                = flag.Bool("dev", false, "Development mode, enables profiler in port 8888. Optionally use the DEV environment variable.")
 	device             = flag.String("device", "gpiochip0", "The /dev device name for GPIO to monitor. Optionally use the DEVICE environment variable.")
 	pin                = flag.Int("pin", rpi.J8p11, "Which GPIO PIN to monitor. Optionally use the PIN environment variable.")
+	inputs             = flag.String("inputs", "", "Monitor several wheels, e.g. \"name=left,pin=17;name=right,pin=27,circumference=0.24\". Each input can set device, pin, directionPin, circumference, pulsesPerRevolution and db, the rest come from the other options. Optionally use the INPUTS environment variable.")
+	directionPin       = flag.Int("directionPin", -1, "Second GPIO PIN with a sensor in quadrature for detecting direction, -1 to disable. Optionally use the DIRECTION_PIN environment variable.")
+	backward           = flag.String("backward", "ignore", "What to do with backward rotation when detecting direction, ignore or subtract. Optionally use the BACKWARD environment variable.")
+	bias               = flag.String("bias", "as-is", "GPIO line bias, as-is, pull-up, pull-down or disabled. Requires Linux v5.5 or later. Optionally use the BIAS environment variable.")
+	activeLow          = flag.Bool("activeLow", false, "Consider the GPIO line active when low. Optionally use the ACTIVE_LOW environment variable.")
+	countEdge          = flag.String("countEdge", "rising", "Which edge of the sensor pulse counts as the wheel turning, rising or falling. Optionally use the COUNT_EDGE environment variable.")
+	debounce           = flag.Duration("debounce", 0, "Kernel debounce period for the GPIO lines, e.g. 5ms, 0 to disable. Requires Linux v5.10 or later. Optionally use the DEBOUNCE environment variable.")
 	wheelCircumference = flag.Float64("circumference", 0.2375, "Measurement wheel circumference in meters. Optionally use the WHEEL_CIRCUMFERENCE environment variable.")
+	pulsesPerRev       = flag.Int("pulsesPerRevolution", 1, "How many pulses the sensor gives per wheel revolution, e.g. number of magnets. Optionally use the PULSES_PER_REVOLUTION environment variable.")
+	minSpeed           = flag.Float64("minSpeed", 0.5, "Slowest speed in km/h to detect, slower movement is ignored. Optionally use the MIN_SPEED environment variable.")
+	maxSpeed           = flag.Float64("maxSpeed", 21.5, "Fastest speed in km/h to expect, faster pulses are considered noise. Optionally use the MAX_SPEED environment variable.")
+	maxAcceleration    = flag.Float64("maxAcceleration", 3.0, "Fastest believable acceleration in m/s², 0 to disable. Optionally use the MAX_ACCELERATION environment variable.")
+	smoothing          = flag.String("smoothing", "average:3", "How to smooth the speed, average:N samples, ema:alpha, median:N samples or kalman:processNoise:measurementNoise. Optionally use the SMOOTHING environment variable.")
+	sampleResolution   = flag.Duration("sampleResolution", 0, "Also report samples finer than a minute, e.g. 5s, 10s or 15s, 0 to disable. Optionally use the SAMPLE_RESOLUTION environment variable.")
+	sessionIdleGap     = flag.Duration("sessionIdleGap", 5*time.Minute, "How long to be idle before a workout session ends. Optionally use the SESSION_IDLE_GAP environment variable.")
 	dbPath             = flag.String("db", "./godometer.txt", "Path to locally stored records. Optionally use the DB_PATH environment variable.")
 	apiBaseUrl         = flag.String("apiBaseUrl", "http://localhost:8080", "API base URL where to report stats to, set as empty string to disable. Optionally use the API_BASE_URL environment variable.")
 	apiAuth            = flag.String("apiAuth", "", "Password for API. Optionally use the API_AUTH environment variable.")
+	reportFile         = flag.String("reportFile", "", "Also append the stats to this file, e.g. godometer-report.csv or godometer-report.jsonl. Optionally use the REPORT_FILE environment variable.")
+	reportFormat       = flag.String("reportFormat", "", "Format of the report file and stdout, csv or jsonl, by default from the file extension. Optionally use the REPORT_FORMAT environment variable.")
+	reportStdout       = flag.Bool("reportStdout", false, "Also write the stats to stdout, the logs go to stderr. Optionally use the REPORT_STDOUT environment variable.")
+	webhookURL         = flag.String("webhookUrl", "", "Also POST the stats as JSON to this URL, empty to disable. Optionally use the WEBHOOK_URL environment variable.")
+	webhookAuth        = flag.String("webhookAuth", "", "Authorization header for the webhook. Optionally use the WEBHOOK_AUTH environment variable.")
+	mqttBroker         = flag.String("mqttBroker", "", "MQTT broker to publish live stats to, e.g. tcp://localhost:1883, empty to disable. Optionally use the MQTT_BROKER environment variable.")
+	mqttClientID       = flag.String("mqttClientId", "", "MQTT client ID, defaults to godometer-<hostname>. Optionally use the MQTT_CLIENT_ID environment variable.")
+	mqttUsername       = flag.String("mqttUsername", "", "MQTT username. Optionally use the MQTT_USERNAME environment variable.")
+	mqttPassword       = flag.String("mqttPassword", "", "MQTT password. Optionally use the MQTT_PASSWORD environment variable.")
+	mqttTopic          = flag.String("mqttTopic", "godometer", "Prefix for the MQTT topics, e.g. godometer/speed, the names after it are fixed. Optionally use the MQTT_TOPIC environment variable.")
+	mqttQoS            = flag.Int("mqttQos", 0, "MQTT quality of service, 0, 1 or 2. Optionally use the MQTT_QOS environment variable.")
+	mqttRetain         = flag.Bool("mqttRetain", true, "Publish MQTT messages as retained. Optionally use the MQTT_RETAIN environment variable.")
+	mqttLiveInterval   = flag.Duration("mqttLiveInterval", time.Second, "How often to publish the live speed to MQTT at most. Optionally use the MQTT_LIVE_INTERVAL environment variable.")
+	mqttDiscovery      = flag.Bool("mqttDiscovery", false, "Publish Home Assistant MQTT discovery configs for the treadmill sensors. Optionally use the MQTT_DISCOVERY environment variable.")
+	discoveryPrefix    = flag.String("mqttDiscoveryPrefix", "homeassistant", "Home Assistant MQTT discovery prefix. Optionally use the MQTT_DISCOVERY_PREFIX environment variable.")
+	influxURL          = flag.String("influxUrl", "", "InfluxDB to write stats to, http://host:8086 for /api/v2/write or udp://host:8089, empty to disable. Optionally use the INFLUX_URL environment variable.")
+	influxOrg          = flag.String("influxOrg", "", "InfluxDB organization. Optionally use the INFLUX_ORG environment variable.")
+	influxBucket       = flag.String("influxBucket", "", "InfluxDB bucket, needed over HTTP. Optionally use the INFLUX_BUCKET environment variable.")
+	influxToken        = flag.String("influxToken", "", "InfluxDB API token. Optionally use the INFLUX_TOKEN environment variable.")
+	influxMeasurement  = flag.String("influxMeasurement", "godometer", "InfluxDB measurement for the minutes, pulses go to <measurement>_pulses. Optionally use the INFLUX_MEASUREMENT environment variable.")
+	influxTags         = flag.String("influxTags", "", "Extra InfluxDB tags for every line, e.g. \"host=pi,room=office\". Optionally use the INFLUX_TAGS environment variable.")
+	influxBatchSize    = flag.Int("influxBatchSize", 100, "How many lines to write to InfluxDB at once. Optionally use the INFLUX_BATCH_SIZE environment variable.")
+	influxFlush        = flag.Duration("influxFlushInterval", 10*time.Second, "How often to write waiting lines to InfluxDB. Optionally use the INFLUX_FLUSH_INTERVAL environment variable.")
+	influxPulses       = flag.Bool("influxPulses", false, "Also write the speed of every pulse to InfluxDB. Optionally use the INFLUX_PULSES environment variable.")
+	shutdownTimeout    = flag.Duration("shutdownTimeout", 20*time.Second, "How long to wait for the final stats to be saved and reported when quitting. Optionally use the SHUTDOWN_TIMEOUT environment variable.")
+	statusAddr         = flag.String("statusAddr", "", "Address to serve the live status and a dashboard on, e.g. :8081, empty to disable. Optionally use the STATUS_ADDR environment variable.")
+	configPath         = flag.String("config", "./godometer.env", "Path to a KEY=value file with environment variables to use as defaults, written by calibrate. Optionally use the CONFIG environment variable.")
+	calibrateDistance  = flag.Float64("calibrateDistance", 0, "Known distance in meters to walk for calibrate, 0 to use -calibrateSpeed instead. Optionally use the CALIBRATE_DISTANCE environment variable.")
+	calibrateSpeed     = flag.Float64("calibrateSpeed", 4.0, "Speed in km/h displayed on the treadmill for calibrate, kept for -duration. Optionally use the CALIBRATE_SPEED environment variable.")
+	duration           = flag.Duration("duration", time.Minute, "How long to run the diagnose and calibrate commands for. Optionally use the DURATION environment variable.")
+	period             = flag.String("period", "day", "How to group the history command, day, week or month. Optionally use the PERIOD environment variable.")
 	quiet              = flag.Bool("quiet", false, "Stop reporting regular updates. Optionally use the QUIET environment variable.")
+	source             = flag.String("source", "gpio", "Where to read pulses from, gpio, simulated or replay. Optionally use the SOURCE environment variable.")
+	simulatedSpeed     = flag.Float64("simulatedSpeed", 4.0, "Speed in km/h for the simulated source. Optionally use the SIMULATED_SPEED environment variable.")
+	recordPulses       = flag.String("recordPulses", "", "Write every raw pulse to this pulse log file. Optionally use the RECORD_PULSES environment variable.")
+	replayFile         = flag.String("replayFile", "", "Pulse log to read for the replay source. Optionally use the REPLAY_FILE environment variable.")
+	replaySpeed        = flag.Float64("replaySpeed", 1.0, "How many times faster than real time to replay pulses. Optionally use the REPLAY_SPEED environment variable.")
 )
 
 type Config struct {
 	dev                bool
 	device             string
 	pin                int
+	inputs             string
+	name               string
+	directionPin       int
+	backward           string
+	bias               string
+	activeLow          bool
+	countEdge          string
+	debounce           time.Duration
 	wheelCircumference float64
+	pulsesPerRev       int
+	minSpeed           float64
+	maxSpeed           float64
+	maxAcceleration    float64
+	smoothing          string
+	sampleResolution   time.Duration
+	sessionIdleGap     time.Duration
 	dbPath             string
 	apiBaseUrl         string
 	apiAuth            string
+	reportFile         string
+	reportFormat       string
+	reportStdout       bool
+	webhookURL         string
+	webhookAuth        string
+	shutdownTimeout    time.Duration
+	statusAddr         string
+	mqttBroker         string
+	mqttClientID       string
+	mqttUsername       string
+	mqttPassword       string
+	mqttTopic          string
+	mqttQoS            int
+	mqttRetain         bool
+	mqttLiveInterval   time.Duration
+	mqttDiscovery      bool
+	discoveryPrefix    string
+	influxURL          string
+	influxOrg          string
+	influxBucket       string
+	influxToken        string
+	influxMeasurement  string
+	influxTags         string
+	influxBatchSize    int
+	influxFlush        time.Duration
+	influxPulses       bool
+	configPath         string
+	calibrateDistance  float64
+	calibrateSpeed     float64
+	duration           time.Duration
+	period             string
 	quiet              bool
+	source             string
+	simulatedSpeed     float64
+	recordPulses       string
+	replayFile         string
+	replaySpeed        float64
 }
 
-func parseConfig() Config {
-	flag.Parse()
+const usage = `Usage: godometer [command] [options]
+
+Commands:
+  (none)     Monitor the wheel and report stats
+  diagnose   Check the sensor signal quality for -duration and print a report
+  calibrate  Work out the wheel circumference from a known distance or speed
+  history    Print totals for every day, week or month (-period) from the local archive
+  summary    Print totals for today, this week, this month and all time from the local archive
+
+Options:
+`
+
+// Split the optional command from the rest of the arguments
+func parseCommand(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+
+	return "", args
+}
+
+func parseConfig(args []string) Config {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	_ = flag.CommandLine.Parse(args)
+
+	path := *configPath
+	if e := os.Getenv("CONFIG"); e != "" {
+		path = e
+	}
+
+	if err := loadConfigFile(path); err != nil {
+		log.Printf("Could not read config file %s: %s", path, err)
+	}
 
 	c := Config{
 		dev:                *dev,
 		device:             *device,
 		pin:                *pin,
+		inputs:             *inputs,
+		directionPin:       *directionPin,
+		backward:           *backward,
+		bias:               *bias,
+		activeLow:          *activeLow,
+		countEdge:          *countEdge,
+		debounce:           *debounce,
 		wheelCircumference: *wheelCircumference,
+		pulsesPerRev:       *pulsesPerRev,
+		minSpeed:           *minSpeed,
+		maxSpeed:           *maxSpeed,
+		maxAcceleration:    *maxAcceleration,
+		smoothing:          *smoothing,
+		sampleResolution:   *sampleResolution,
+		sessionIdleGap:     *sessionIdleGap,
 		dbPath:             *dbPath,
 		apiBaseUrl:         *apiBaseUrl,
 		apiAuth:            *apiAuth,
+		reportFile:         *reportFile,
+		reportFormat:       *reportFormat,
+		reportStdout:       *reportStdout,
+		webhookURL:         *webhookURL,
+		webhookAuth:        *webhookAuth,
+		shutdownTimeout:    *shutdownTimeout,
+		statusAddr:         *statusAddr,
+		mqttBroker:         *mqttBroker,
+		mqttClientID:       *mqttClientID,
+		mqttUsername:       *mqttUsername,
+		mqttPassword:       *mqttPassword,
+		mqttTopic:          *mqttTopic,
+		mqttQoS:            *mqttQoS,
+		mqttRetain:         *mqttRetain,
+		mqttLiveInterval:   *mqttLiveInterval,
+		mqttDiscovery:      *mqttDiscovery,
+		discoveryPrefix:    *discoveryPrefix,
+		influxURL:          *influxURL,
+		influxOrg:          *influxOrg,
+		influxBucket:       *influxBucket,
+		influxToken:        *influxToken,
+		influxMeasurement:  *influxMeasurement,
+		influxTags:         *influxTags,
+		influxBatchSize:    *influxBatchSize,
+		influxFlush:        *influxFlush,
+		influxPulses:       *influxPulses,
+		configPath:         path,
+		calibrateDistance:  *calibrateDistance,
+		calibrateSpeed:     *calibrateSpeed,
+		duration:           *duration,
+		period:             *period,
 		quiet:              *quiet,
+		source:             *source,
+		simulatedSpeed:     *simulatedSpeed,
+		recordPulses:       *recordPulses,
+		replayFile:         *replayFile,
+		replaySpeed:        *replaySpeed,
 	}
 
 	if e := os.Getenv("DEVICE"); e != "" {
@@ -62,6 +251,48 @@ func parseConfig() Config {
 		}
 	}
 
+	if e := os.Getenv("INPUTS"); e != "" {
+		c.inputs = e
+	}
+
+	if e := os.Getenv("DIRECTION_PIN"); e != "" {
+		i, err := strconv.Atoi(e)
+		if err != nil {
+			log.Printf("Could not parse DIRECTION_PIN environment variable: %s", err)
+		} else {
+			c.directionPin = i
+		}
+	}
+
+	if e := os.Getenv("BACKWARD"); e != "" {
+		c.backward = e
+	}
+
+	if e := os.Getenv("BIAS"); e != "" {
+		c.bias = e
+	}
+
+	if e := os.Getenv("ACTIVE_LOW"); e != "" {
+		if e == "1" || e == "yes" || e == "true" {
+			c.activeLow = true
+		} else {
+			c.activeLow = false
+		}
+	}
+
+	if e := os.Getenv("COUNT_EDGE"); e != "" {
+		c.countEdge = e
+	}
+
+	if e := os.Getenv("DEBOUNCE"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse DEBOUNCE environment variable: %s", err)
+		} else {
+			c.debounce = d
+		}
+	}
+
 	if e := os.Getenv("WHEEL_CIRCUMFERENCE"); e != "" {
 		f, err := strconv.ParseFloat(e, 64)
 		if err != nil {
@@ -71,6 +302,64 @@ func parseConfig() Config {
 		}
 	}
 
+	if e := os.Getenv("PULSES_PER_REVOLUTION"); e != "" {
+		i, err := strconv.Atoi(e)
+		if err != nil {
+			log.Printf("Could not parse PULSES_PER_REVOLUTION environment variable: %s", err)
+		} else {
+			c.pulsesPerRev = i
+		}
+	}
+
+	if e := os.Getenv("MIN_SPEED"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse MIN_SPEED environment variable: %s", err)
+		} else {
+			c.minSpeed = f
+		}
+	}
+
+	if e := os.Getenv("MAX_SPEED"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse MAX_SPEED environment variable: %s", err)
+		} else {
+			c.maxSpeed = f
+		}
+	}
+
+	if e := os.Getenv("MAX_ACCELERATION"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse MAX_ACCELERATION environment variable: %s", err)
+		} else {
+			c.maxAcceleration = f
+		}
+	}
+
+	if e := os.Getenv("SMOOTHING"); e != "" {
+		c.smoothing = e
+	}
+
+	if e := os.Getenv("SAMPLE_RESOLUTION"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse SAMPLE_RESOLUTION environment variable: %s", err)
+		} else {
+			c.sampleResolution = d
+		}
+	}
+
+	if e := os.Getenv("SESSION_IDLE_GAP"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse SESSION_IDLE_GAP environment variable: %s", err)
+		} else {
+			c.sessionIdleGap = d
+		}
+	}
+
 	if e := os.Getenv("DB_PATH"); e != "" {
 		c.dbPath = e
 	}
@@ -83,6 +372,182 @@ func parseConfig() Config {
 		c.apiAuth = e
 	}
 
+	if e := os.Getenv("REPORT_FILE"); e != "" {
+		c.reportFile = e
+	}
+
+	if e := os.Getenv("REPORT_FORMAT"); e != "" {
+		c.reportFormat = e
+	}
+
+	if e := os.Getenv("REPORT_STDOUT"); e != "" {
+		if e == "1" || e == "yes" || e == "true" {
+			c.reportStdout = true
+		} else {
+			c.reportStdout = false
+		}
+	}
+
+	if e := os.Getenv("WEBHOOK_URL"); e != "" {
+		c.webhookURL = e
+	}
+
+	if e := os.Getenv("WEBHOOK_AUTH"); e != "" {
+		c.webhookAuth = e
+	}
+
+	if e := os.Getenv("SHUTDOWN_TIMEOUT"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse SHUTDOWN_TIMEOUT environment variable: %s", err)
+		} else {
+			c.shutdownTimeout = d
+		}
+	}
+
+	if e := os.Getenv("STATUS_ADDR"); e != "" {
+		c.statusAddr = e
+	}
+
+	if e := os.Getenv("MQTT_BROKER"); e != "" {
+		c.mqttBroker = e
+	}
+
+	if e := os.Getenv("MQTT_CLIENT_ID"); e != "" {
+		c.mqttClientID = e
+	}
+
+	if e := os.Getenv("MQTT_USERNAME"); e != "" {
+		c.mqttUsername = e
+	}
+
+	if e := os.Getenv("MQTT_PASSWORD"); e != "" {
+		c.mqttPassword = e
+	}
+
+	if e := os.Getenv("MQTT_TOPIC"); e != "" {
+		c.mqttTopic = e
+	}
+
+	if e := os.Getenv("MQTT_QOS"); e != "" {
+		i, err := strconv.Atoi(e)
+		if err != nil {
+			log.Printf("Could not parse MQTT_QOS environment variable: %s", err)
+		} else {
+			c.mqttQoS = i
+		}
+	}
+
+	if e := os.Getenv("MQTT_RETAIN"); e != "" {
+		if e == "1" || e == "yes" || e == "true" {
+			c.mqttRetain = true
+		} else {
+			c.mqttRetain = false
+		}
+	}
+
+	if e := os.Getenv("MQTT_LIVE_INTERVAL"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse MQTT_LIVE_INTERVAL environment variable: %s", err)
+		} else {
+			c.mqttLiveInterval = d
+		}
+	}
+
+	if e := os.Getenv("MQTT_DISCOVERY"); e != "" {
+		if e == "1" || e == "yes" || e == "true" {
+			c.mqttDiscovery = true
+		} else {
+			c.mqttDiscovery = false
+		}
+	}
+
+	if e := os.Getenv("MQTT_DISCOVERY_PREFIX"); e != "" {
+		c.discoveryPrefix = e
+	}
+
+	if e := os.Getenv("INFLUX_URL"); e != "" {
+		c.influxURL = e
+	}
+
+	if e := os.Getenv("INFLUX_ORG"); e != "" {
+		c.influxOrg = e
+	}
+
+	if e := os.Getenv("INFLUX_BUCKET"); e != "" {
+		c.influxBucket = e
+	}
+
+	if e := os.Getenv("INFLUX_TOKEN"); e != "" {
+		c.influxToken = e
+	}
+
+	if e := os.Getenv("INFLUX_MEASUREMENT"); e != "" {
+		c.influxMeasurement = e
+	}
+
+	if e := os.Getenv("INFLUX_TAGS"); e != "" {
+		c.influxTags = e
+	}
+
+	if e := os.Getenv("INFLUX_BATCH_SIZE"); e != "" {
+		i, err := strconv.Atoi(e)
+		if err != nil {
+			log.Printf("Could not parse INFLUX_BATCH_SIZE environment variable: %s", err)
+		} else {
+			c.influxBatchSize = i
+		}
+	}
+
+	if e := os.Getenv("INFLUX_FLUSH_INTERVAL"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse INFLUX_FLUSH_INTERVAL environment variable: %s", err)
+		} else {
+			c.influxFlush = d
+		}
+	}
+
+	if e := os.Getenv("INFLUX_PULSES"); e != "" {
+		if e == "1" || e == "yes" || e == "true" {
+			c.influxPulses = true
+		} else {
+			c.influxPulses = false
+		}
+	}
+
+	if e := os.Getenv("CALIBRATE_DISTANCE"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse CALIBRATE_DISTANCE environment variable: %s", err)
+		} else {
+			c.calibrateDistance = f
+		}
+	}
+
+	if e := os.Getenv("CALIBRATE_SPEED"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse CALIBRATE_SPEED environment variable: %s", err)
+		} else {
+			c.calibrateSpeed = f
+		}
+	}
+
+	if e := os.Getenv("DURATION"); e != "" {
+		d, err := time.ParseDuration(e)
+		if err != nil {
+			log.Printf("Could not parse DURATION environment variable: %s", err)
+		} else {
+			c.duration = d
+		}
+	}
+
+	if e := os.Getenv("PERIOD"); e != "" {
+		c.period = e
+	}
+
 	if e := os.Getenv("QUIET"); e != "" {
 		if e == "1" || e == "yes" || e == "true" {
 			c.quiet = true
@@ -91,6 +556,36 @@ func parseConfig() Config {
 		}
 	}
 
+	if e := os.Getenv("SOURCE"); e != "" {
+		c.source = e
+	}
+
+	if e := os.Getenv("SIMULATED_SPEED"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse SIMULATED_SPEED environment variable: %s", err)
+		} else {
+			c.simulatedSpeed = f
+		}
+	}
+
+	if e := os.Getenv("RECORD_PULSES"); e != "" {
+		c.recordPulses = e
+	}
+
+	if e := os.Getenv("REPLAY_FILE"); e != "" {
+		c.replayFile = e
+	}
+
+	if e := os.Getenv("REPLAY_SPEED"); e != "" {
+		f, err := strconv.ParseFloat(e, 64)
+		if err != nil {
+			log.Printf("Could not parse REPLAY_SPEED environment variable: %s", err)
+		} else {
+			c.replaySpeed = f
+		}
+	}
+
 	if e := os.Getenv("dev"); e != "" {
 		if e == "1" || e == "yes" || e == "true" {
 			c.dev = true
@@ -99,6 +594,29 @@ func parseConfig() Config {
 		}
 	}
 
+	// A replay must not mix with the real records, so it only uses the DB and reports to
+	// the places given explicitly
+	if c.source == "replay" {
+		if !explicitlySet("db", "DB_PATH") {
+			c.dbPath = "./godometer-replay.txt"
+		}
+		if !explicitlySet("apiBaseUrl", "API_BASE_URL") {
+			c.apiBaseUrl = ""
+		}
+		if !explicitlySet("webhookUrl", "WEBHOOK_URL") {
+			c.webhookURL = ""
+		}
+		if !explicitlySet("reportFile", "REPORT_FILE") {
+			c.reportFile = ""
+		}
+		if !explicitlySet("influxUrl", "INFLUX_URL") {
+			c.influxURL = ""
+		}
+		if !explicitlySet("mqttBroker", "MQTT_BROKER") {
+			c.mqttBroker = ""
+		}
+	}
+
 	return c
 }
 
@@ -110,28 +628,413 @@ func (c Config) Print() {
 
 	log.Print(" ----- CONFIGURATION ----- ")
 	log.Printf("Wheel circumference: %.5fm", c.wheelCircumference)
+	log.Printf("Pulses per rotation: %d", c.pulsesPerRev)
+	log.Printf("Speed range: %.1f-%.1fkm/h, max acceleration %.1fm/s²", c.minSpeed, c.maxSpeed, c.maxAcceleration)
+	log.Printf("Smoothing: %s", c.smoothing)
+	if c.sampleResolution > 0 {
+		log.Printf("Sample resolution: %s", c.sampleResolution)
+	}
+	log.Printf("Session idle gap: %s", c.sessionIdleGap)
 
-	log.Printf("Device:  %s", c.device)
-	log.Printf("Pin:     %d", c.pin)
-	log.Printf("DB path: %s", c.dbPath)
+	log.Printf("Source:  %s", c.source)
+	if c.source == "simulated" {
+		log.Printf("Speed:   %.1fkm/h", c.simulatedSpeed)
+	} else if c.source == "replay" {
+		log.Printf("Replay:  %s at %.1fx", c.replayFile, c.replaySpeed)
+	} else if c.inputs == "" {
+		log.Printf("Device:  %s", c.device)
+		log.Printf("Pin:     %d", c.pin)
+		if c.directionPin >= 0 {
+			log.Printf("Direction pin: %d, backward: %s", c.directionPin, c.backward)
+		}
+	}
+	if c.source == "gpio" {
+		log.Printf("Bias: %s, active low: %t, count edge: %s, debounce: %s", c.bias, c.activeLow, c.countEdge, c.debounce)
+	}
+
+	if c.inputs != "" {
+		inputs, err := c.parseInputs()
+		if err != nil {
+			log.Fatalf("Invalid inputs: %s", err)
+		}
+		for _, input := range inputs {
+			log.Printf("Input %s: %s pin %d, %.5fm, %d pulses per rotation, DB path %s", input.name, input.device, input.pin, input.wheelCircumference, input.pulsesPerRev, input.dbPath)
+		}
+	} else {
+		log.Printf("DB path: %s", c.dbPath)
+	}
+	if c.recordPulses != "" {
+		log.Printf("Pulses:  %s", c.recordPulses)
+	}
 
 	log.Printf("API base URL: %s", c.apiBaseUrl)
 	log.Printf("API pwd:      %s", pwd)
+	if c.reportFile != "" {
+		log.Printf("Report file: %s", c.reportFile)
+	}
+	if c.reportStdout {
+		log.Printf("Reporting to stdout")
+	}
+	if c.webhookURL != "" {
+		log.Printf("Webhook: %s", c.webhookURL)
+	}
+	if c.statusAddr != "" {
+		log.Printf("Status address: %s", c.statusAddr)
+	}
+	if c.mqttBroker != "" {
+		log.Printf("MQTT broker: %s, topic %s, QoS %d, retain %t", c.mqttBroker, c.mqttTopic, c.mqttQoS, c.mqttRetain)
+		if c.mqttDiscovery {
+			log.Printf("Home Assistant discovery: %s", c.discoveryPrefix)
+		}
+	}
+	if c.influxURL != "" {
+		log.Printf("InfluxDB: %s, measurement %s, pulses %t", c.influxURL, c.influxMeasurement, c.influxPulses)
+	}
 }
 
-func main() {
-	config := parseConfig()
-	config.Print()
+func (c Config) lineOptions() monitor.GPIOLineOptions {
+	options := monitor.DefaultGPIOLineOptions()
+
+	b, err := monitor.ParseBias(c.bias)
+	if err != nil {
+		log.Fatalf("Invalid bias: %s", err)
+	}
+	options.Bias = b
+
+	e, err := monitor.ParseEdge(c.countEdge)
+	if err != nil {
+		log.Fatalf("Invalid count edge: %s", err)
+	}
+	options.CountEdge = e
+
+	options.ActiveLow = c.activeLow
+	options.Debounce = c.debounce
+
+	return options
+}
+
+func (c Config) glitchFilter() monitor.GlitchFilter {
+	if c.minSpeed <= 0 || c.maxSpeed <= c.minSpeed {
+		log.Fatalf("Invalid speed range %.1f-%.1fkm/h", c.minSpeed, c.maxSpeed)
+	}
+
+	filter := monitor.DefaultGlitchFilter()
+	filter.MinKilometersPerHour = c.minSpeed
+	filter.MaxKilometersPerHour = c.maxSpeed
+	filter.MaxAcceleration = c.maxAcceleration
 
-	exit := make(chan bool)
-	exit2 := make(chan bool)
+	return filter
+}
+
+// Every input needs its own filter as they keep history
+func (c Config) speedFilter() monitor.SpeedFilter {
+	filter, err := monitor.ParseSpeedFilter(c.smoothing)
+	if err != nil {
+		log.Fatalf("Invalid smoothing: %s", err)
+	}
+
+	return filter
+}
+
+func (c Config) mqttOptions() monitor.MQTTOptions {
+	if c.mqttQoS < 0 || c.mqttQoS > 2 {
+		log.Fatalf("Invalid MQTT QoS %d, expected 0, 1 or 2", c.mqttQoS)
+	}
+
+	clientID := c.mqttClientID
+	if clientID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			hostname = "unknown"
+		}
+		clientID = "godometer-" + hostname
+	}
+
+	return monitor.MQTTOptions{
+		Broker:          c.mqttBroker,
+		ClientID:        clientID,
+		Username:        c.mqttUsername,
+		Password:        c.mqttPassword,
+		TopicPrefix:     c.mqttTopic,
+		QoS:             byte(c.mqttQoS),
+		Retain:          c.mqttRetain,
+		LiveInterval:    c.mqttLiveInterval,
+		Discovery:       c.mqttDiscovery,
+		DiscoveryPrefix: c.discoveryPrefix,
+	}
+}
+
+// Reporters shared by all the inputs
+func (c Config) sharedReporters() []monitor.Reporter {
+	var reporters []monitor.Reporter
+	if c.reportFile != "" {
+		fr, err := monitor.NewFileReporter(c.reportFile, c.reportFormat)
+		if err != nil {
+			log.Fatalf("Invalid report file: %s", err)
+		}
+		reporters = append(reporters, fr)
+	}
+
+	if c.reportStdout {
+		format := c.reportFormat
+		if format == "" {
+			format = "jsonl"
+		}
+
+		wr, err := monitor.NewWriterReporter("stdout", os.Stdout, format)
+		if err != nil {
+			log.Fatalf("Invalid report format: %s", err)
+		}
+		reporters = append(reporters, wr)
+	}
+
+	return reporters
+}
+
+// Reporters of one input, they keep their outboxes next to its DB
+func (c Config) inputReporters() []monitor.Reporter {
+	var reporters []monitor.Reporter
+	if c.apiBaseUrl != "" {
+		reporters = append(reporters, monitor.NewGodoservReporter(c.dbPath, c.apiBaseUrl, c.apiAuth))
+	}
+
+	if c.webhookURL != "" {
+		reporters = append(reporters, monitor.NewWebhookReporter(c.dbPath, c.webhookURL, c.webhookAuth))
+	}
+
+	return reporters
+}
+
+func (c Config) influxOptions() monitor.InfluxOptions {
+	tags, err := monitor.ParseInfluxTags(c.influxTags)
+	if err != nil {
+		log.Fatalf("Invalid InfluxDB tags: %s", err)
+	}
+
+	if c.influxBatchSize < 1 || c.influxFlush <= 0 {
+		log.Fatalf("InfluxDB batch size and flush interval need to be positive")
+	}
+
+	return monitor.InfluxOptions{
+		URL:           c.influxURL,
+		Org:           c.influxOrg,
+		Bucket:        c.influxBucket,
+		Token:         c.influxToken,
+		Measurement:   c.influxMeasurement,
+		Tags:          tags,
+		BatchSize:     c.influxBatchSize,
+		FlushInterval: c.influxFlush,
+		Pulses:        c.influxPulses,
+	}
+}
+
+// Where to read pulses from, the replay source stops by itself at the end of the file
+func (c Config) pulseSource() monitor.PulseSource {
+	switch c.source {
+	case "gpio":
+		return monitor.NewGPIOMonitor(c.device, c.pin, c.directionPin, c.lineOptions())
+	case "simulated":
+		return monitor.NewSimulatedSource(c.simulatedSpeed, 0.1, c.wheelCircumference, c.pulsesPerRev)
+	case "replay":
+		if c.replayFile == "" || c.replaySpeed <= 0 {
+			log.Fatal("Replay source needs a replay file and a positive replay speed")
+		}
+		return monitor.NewReplaySource(c.replayFile, c.replaySpeed)
+	}
+
+	log.Fatalf("Unknown pulse source %s", c.source)
+	return nil
+}
+
+func (c Config) newWheel(results chan monitor.GPIORecord) *monitor.Wheel {
+	wheel := monitor.NewWheel(c.wheelCircumference, c.pulsesPerRev, c.glitchFilter(), results)
+
+	if c.directionPin >= 0 || c.source == "replay" {
+		switch c.backward {
+		case "ignore":
+			wheel.DetectDirection(false)
+		case "subtract":
+			wheel.DetectDirection(true)
+		default:
+			log.Fatalf("Unknown backward mode %s", c.backward)
+		}
+	}
+
+	return wheel
+}
+
+// An input being monitored, stopped in order when shutting down
+type runningInput struct {
+	name        string
+	sm          *monitor.StatsMonitor
+	plw         *monitor.PulseLogWriter
+	stopSource  context.CancelFunc
+	sourceDone  chan bool
+	sourceErr   error
+	stopMonitor context.CancelFunc
+	monitorDone chan bool
+}
+
+// Start reading pulses for one input, the stats are monitored once its reporters are added
+func startInput(config Config) *runningInput {
 	results := make(chan monitor.GPIORecord, 100)
 
-	gm := monitor.NewGPIOMonitor(config.device, config.pin, config.wheelCircumference, results)
-	sm := monitor.NewStatsMonitor(results, config.dbPath, config.apiBaseUrl, config.apiAuth)
+	ps := config.pulseSource()
+	wheel := config.newWheel(results)
 
-	go gm.Monitor(exit)
-	go sm.Monitor(config.quiet, exit2)
+	ri := &runningInput{}
+	ri.name = config.name
+	ri.sm = monitor.NewStatsMonitor(results, config.speedFilter(), wheel.IdleTimeout(), config.sessionIdleGap, config.sampleResolution, config.name, config.dbPath)
+	ri.sm.AddCounterSource(wheel)
+	if cs, ok := ps.(monitor.CounterSource); ok {
+		ri.sm.AddCounterSource(cs)
+	}
+	ri.sourceDone = make(chan bool)
+	ri.monitorDone = make(chan bool)
+
+	if config.recordPulses != "" {
+		var err error
+		ri.plw, err = monitor.NewPulseLogWriter(config.recordPulses)
+		if err != nil {
+			log.Fatalf("Could not open pulse log %s: %s", config.recordPulses, err)
+		}
+		wheel.AddObserver(ri.plw.Record)
+	}
+
+	var ctx context.Context
+	ctx, ri.stopSource = context.WithCancel(context.Background())
+	go func() {
+		ri.sourceErr = ps.Monitor(ctx, wheel.Handle)
+		close(ri.sourceDone)
+	}()
+
+	return ri
+}
+
+func (ri *runningInput) label() string {
+	if ri.name == "" {
+		return "the input"
+	}
+	return "input " + ri.name
+}
+
+func (ri *runningInput) monitor(quiet bool) {
+	var ctx context.Context
+	ctx, ri.stopMonitor = context.WithCancel(context.Background())
+	go func() {
+		ri.sm.Monitor(ctx, quiet)
+		close(ri.monitorDone)
+	}()
+}
+
+// Stop the pulses first, which also closes the GPIO lines, then save and report what's
+// left of the current minute
+func (ri *runningInput) stop() {
+	ri.stopSource()
+	<-ri.sourceDone
+
+	ri.stopMonitor()
+	<-ri.monitorDone
+
+	if ri.plw != nil {
+		_ = ri.plw.Close()
+	}
+}
+
+// Stop all the inputs at the same time, giving up after timeout
+func stopInputs(running []*runningInput, timeout time.Duration) {
+	done := make(chan bool)
+	go func() {
+		var wg sync.WaitGroup
+		for _, ri := range running {
+			wg.Add(1)
+			go func(ri *runningInput) {
+				defer wg.Done()
+				ri.stop()
+			}(ri)
+		}
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Printf("Final stats saved")
+	case <-time.After(timeout):
+		log.Printf("Gave up waiting for the final stats to be saved and reported after %s", timeout)
+	}
+}
+
+// Runs until stopped with a signal, or until an input stops by itself, e.g. a replay
+// finishing. Returns an error if an input could not be monitored.
+func runMonitor(config Config) error {
+	if config.sampleResolution < 0 || (config.sampleResolution > 0 && (config.sampleResolution%time.Second != 0 || time.Minute%config.sampleResolution != 0)) {
+		log.Fatalf("Invalid sample resolution %s, it needs to be whole seconds that divide a minute evenly", config.sampleResolution)
+	}
+
+	inputs := []Config{config}
+	if config.inputs != "" {
+		if config.source == "replay" {
+			log.Fatal("Replay source only supports a single input")
+		}
+
+		var err error
+		inputs, err = config.parseInputs()
+		if err != nil {
+			log.Fatalf("Invalid inputs: %s", err)
+		}
+	}
+
+	ctx := shutdownContext()
+
+	var status *monitor.StatusServer
+	if config.statusAddr != "" {
+		status = monitor.NewStatusServer(config.statusAddr)
+		status.Start()
+	}
+
+	var mqttReporter *monitor.MQTTReporter
+	if config.mqttBroker != "" {
+		mqttReporter = monitor.NewMQTTReporter(config.mqttOptions())
+		mqttReporter.Start()
+		defer mqttReporter.Close()
+	}
+
+	var influxReporter *monitor.InfluxReporter
+	if config.influxURL != "" {
+		var err error
+		influxReporter, err = monitor.NewInfluxReporter(config.influxOptions())
+		if err != nil {
+			log.Fatalf("Invalid InfluxDB settings: %s", err)
+		}
+		influxReporter.Start()
+		defer influxReporter.Close()
+	}
+
+	shared := config.sharedReporters()
+
+	var running []*runningInput
+	for _, input := range inputs {
+		ri := startInput(input)
+		for _, r := range input.inputReporters() {
+			ri.sm.AddReporter(r)
+		}
+		for _, r := range shared {
+			ri.sm.AddReporter(r)
+		}
+		if status != nil {
+			status.Add(ri.sm)
+		}
+		if mqttReporter != nil {
+			ri.sm.SetMQTTReporter(mqttReporter)
+		}
+		if influxReporter != nil {
+			ri.sm.SetInfluxReporter(influxReporter)
+		}
+
+		ri.monitor(config.quiet)
+		running = append(running, ri)
+	}
 
 	if config.dev {
 		go func() {
@@ -139,10 +1042,64 @@ func main() {
 		}()
 	}
 
-	defer func() { exit <- true }()
-	defer func() { exit2 <- true }()
+	// A source stopping by itself stops everything, saving the final stats
+	stopped := make(chan *runningInput, len(running))
+	for _, ri := range running {
+		go func(ri *runningInput) {
+			<-ri.sourceDone
+			stopped <- ri
+		}(ri)
+	}
+
+	sdNotify("READY=1")
 
-	for {
-		time.Sleep(10 * time.Second)
+	watchdogCtx, stopWatchdog := context.WithCancel(ctx)
+	defer stopWatchdog()
+	if interval := sdWatchdogInterval(); interval > 0 {
+		log.Printf("Pinging the systemd watchdog every %s", interval/2)
+		go runWatchdog(watchdogCtx, interval, running)
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case ri := <-stopped:
+		if ri.sourceErr != nil {
+			err = fmt.Errorf("%s stopped: %s", ri.label(), ri.sourceErr)
+			log.Printf("Shutting down, %s", err)
+		}
+	}
+
+	stopWatchdog()
+	sdNotify("STOPPING=1")
+	stopInputs(running, config.shutdownTimeout)
+
+	return err
+}
+
+func main() {
+	command, args := parseCommand(os.Args[1:])
+	config := parseConfig(args)
+
+	// The offline commands only print their own output
+	if command != "history" && command != "summary" {
+		config.Print()
+	}
+
+	switch command {
+	case "":
+		if err := runMonitor(config); err != nil {
+			log.Fatalf("Monitor failed: %s", err)
+		}
+	case "diagnose":
+		runDiagnose(config)
+	case "calibrate":
+		runCalibrate(config)
+	case "history":
+		runHistory(config)
+	case "summary":
+		runSummary(config)
+	default:
+		log.Fatalf("Unknown command %s, see -help", command)
 	}
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lietu/godometer/monitor"
+)
+
+// Local DB paths to read the archive of, with a name for each when there are several inputs
+func (c Config) archives() ([]string, []string) {
+	if c.inputs == "" {
+		return []string{""}, []string{c.dbPath}
+	}
+
+	inputs, err := c.parseInputs()
+	if err != nil {
+		log.Fatalf("Invalid inputs: %s", err)
+	}
+
+	var names []string
+	var paths []string
+	for _, input := range inputs {
+		names = append(names, input.name)
+		paths = append(paths, input.dbPath)
+	}
+
+	return names, paths
+}
+
+func readArchive(name string, path string) []monitor.FileDataPoint {
+	dataPoints, err := monitor.ReadArchive(path)
+	if err != nil {
+		log.Fatalf("Could not read archive for %s: %s", path, err)
+	}
+
+	if name != "" {
+		fmt.Printf("Input %s\n", name)
+	}
+
+	if len(dataPoints) == 0 {
+		fmt.Printf("No archived data found next to %s\n", path)
+	}
+
+	return dataPoints
+}
+
+func formatMovingTime(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+}
+
+func printSummaries(title string, summaries []monitor.PeriodSummary) {
+	fmt.Printf("%-12s %10s %10s %9s %9s %6s %10s\n", title, "Distance", "Moving", "Avg km/h", "Max km/h", "Days", "km/day")
+	for _, ps := range summaries {
+		fmt.Printf("%-12s %7.2f km %10s %9.1f %9.1f %6d %10.2f\n",
+			ps.Label,
+			ps.Meters/1000.0,
+			formatMovingTime(ps.MovingSeconds),
+			ps.KilometersPerHour(),
+			ps.MaxKilometersPerHour,
+			ps.ActiveDays,
+			ps.MetersPerActiveDay()/1000.0,
+		)
+	}
+}
+
+func runHistory(config Config) {
+	names, paths := config.archives()
+	for i, path := range paths {
+		dataPoints := readArchive(names[i], path)
+		if len(dataPoints) == 0 {
+			continue
+		}
+
+		summaries, err := monitor.Summarize(dataPoints, config.period, time.Local)
+		if err != nil {
+			log.Fatalf("Invalid period: %s", err)
+		}
+
+		var total float64
+		for _, ps := range summaries {
+			total += ps.Meters
+		}
+
+		printSummaries("Period", summaries)
+		if len(summaries) > 0 {
+			fmt.Printf("Average %.2f km per %s over %d\n", total/float64(len(summaries))/1000.0, config.period, len(summaries))
+		}
+		fmt.Println()
+	}
+}
+
+func runSummary(config Config) {
+	ranges := []struct {
+		period string
+		label  string
+	}{
+		{"day", "Today"},
+		{"week", "This week"},
+		{"month", "This month"},
+		{"", "All time"},
+	}
+
+	now := time.Now()
+	names, paths := config.archives()
+	for i, path := range paths {
+		dataPoints := readArchive(names[i], path)
+		if len(dataPoints) == 0 {
+			continue
+		}
+
+		var summaries []monitor.PeriodSummary
+		for _, r := range ranges {
+			ps, err := monitor.SummarizeSince(dataPoints, r.period, r.label, now)
+			if err != nil {
+				log.Fatalf("Could not summarize: %s", err)
+			}
+			summaries = append(summaries, ps)
+		}
+
+		printSummaries("", summaries)
+		fmt.Println()
+	}
+}
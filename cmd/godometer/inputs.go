@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Add the input name to a file path, e.g. godometer.txt -> godometer-left.txt
+func inputPath(path string, name string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// Parse the -inputs list, e.g. "name=left,pin=17;name=right,pin=27,circumference=0.24".
+// Inputs are separated by semicolons, anything not given for an input comes from the
+// other options, and file paths get the input name added to keep them apart.
+func (c Config) parseInputs() ([]Config, error) {
+	var inputs []Config
+	names := map[string]bool{}
+
+	for _, entry := range strings.Split(c.inputs, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		input := c
+		input.inputs = ""
+		input.name = ""
+		dbPath := ""
+
+		for _, field := range strings.Split(entry, ",") {
+			parts := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid input setting %q, expected key=value", field)
+			}
+
+			key := parts[0]
+			value := parts[1]
+
+			var err error
+			switch key {
+			case "name":
+				input.name = value
+			case "device":
+				input.device = value
+			case "pin":
+				input.pin, err = strconv.Atoi(value)
+			case "directionPin":
+				input.directionPin, err = strconv.Atoi(value)
+			case "circumference":
+				input.wheelCircumference, err = strconv.ParseFloat(value, 64)
+			case "pulsesPerRevolution":
+				input.pulsesPerRev, err = strconv.Atoi(value)
+			case "db":
+				dbPath = value
+			default:
+				return nil, fmt.Errorf("unknown input setting %q", key)
+			}
+
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s for input: %s", key, err)
+			}
+		}
+
+		if input.name == "" {
+			return nil, fmt.Errorf("input %q has no name", entry)
+		}
+
+		// Names end up in MQTT topics, where these have a special meaning, and in file names
+		if strings.ContainsAny(input.name, "/+#") {
+			return nil, fmt.Errorf("input name %q can't contain /, + or #", input.name)
+		}
+
+		if names[input.name] {
+			return nil, fmt.Errorf("input name %s is used more than once", input.name)
+		}
+		names[input.name] = true
+
+		input.dbPath = inputPath(c.dbPath, input.name)
+		if dbPath != "" {
+			input.dbPath = dbPath
+		}
+
+		if c.recordPulses != "" {
+			input.recordPulses = inputPath(c.recordPulses, input.name)
+		}
+
+		inputs = append(inputs, input)
+	}
+
+	return inputs, nil
+}
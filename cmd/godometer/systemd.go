@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Tell systemd about the state of the service, e.g. READY=1. Does nothing when not
+// started by systemd with Type=notify.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+
+	// Abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Could not notify systemd: %s", err)
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Could not notify systemd: %s", err)
+	}
+}
+
+// How often systemd expects to hear from the service, zero when the watchdog is not enabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// Meant for another process
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Ping the systemd watchdog until ctx is done, as long as all the inputs are alive. If one
+// gets stuck the pings stop and systemd restarts the service.
+func runWatchdog(ctx context.Context, interval time.Duration, running []*runningInput) {
+	tick := time.NewTicker(interval / 2)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			if stuck := stuckInput(running, interval); stuck != nil {
+				log.Printf("The monitor of %s has not been responding since %s, not pinging the watchdog", stuck.label(), stuck.sm.LastAlive().Format(time.RFC3339))
+				continue
+			}
+			sdNotify("WATCHDOG=1")
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func stuckInput(running []*runningInput, interval time.Duration) *runningInput {
+	for _, ri := range running {
+		if time.Since(ri.sm.LastAlive()) > interval {
+			return ri
+		}
+	}
+	return nil
+}
+
+// Cancelled on SIGINT or SIGTERM, a second one quits right away
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Got %s, shutting down", sig)
+		cancel()
+
+		sig = <-signals
+		log.Printf("Got %s again, quitting without waiting", sig)
+		os.Exit(1)
+	}()
+
+	return ctx
+}
@@ -2,6 +2,9 @@ package godometer
 
 const APITimeLayout = "2006-01-02 15:04"
 
+// Samples finer than a minute start at a timestamp in this format
+const APISampleTimeLayout = "2006-01-02 15:04:05"
+
 type UpdateDataPoint struct {
 	Timestamp         string  `json:"ts"`
 	Meters            float32 `json:"m"`
@@ -15,6 +18,54 @@ type APIRow struct {
 	KilometersPerHour float32 `json:"kph"`
 }
 
+// A bucket of Seconds starting from Timestamp, finer than the minute data points
+type UpdateSample struct {
+	Timestamp         string  `json:"ts"`
+	Seconds           int     `json:"s"`
+	Meters            float32 `json:"m"`
+	MetersPerSecond   float32 `json:"mps"`
+	KilometersPerHour float32 `json:"kph"`
+}
+
+// A workout, Start and End are RFC3339 in UTC
+type UpdateSession struct {
+	Start                string  `json:"start"`
+	End                  string  `json:"end"`
+	MovingSeconds        float32 `json:"mv"`
+	Meters               float32 `json:"m"`
+	MetersPerSecond      float32 `json:"mps"`
+	KilometersPerHour    float32 `json:"kph"`
+	MaxMetersPerSecond   float32 `json:"maxMps"`
+	MaxKilometersPerHour float32 `json:"maxKph"`
+}
+
+// What the server did with each thing in an update
+const (
+	UpdateAccepted  = "accepted"
+	UpdateDuplicate = "duplicate"
+	UpdateRejected  = "rejected"
+)
+
+// Key is the timestamp of a data point or sample, or the start of a session
+type UpdateResult struct {
+	Key    string `json:"key"`
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Only the things with a result were handled, the rest should be sent again. Error is set
+// with an error status when saving failed, then everything should be sent again.
+type UpdateStatsResponse struct {
+	DataPoints []UpdateResult `json:"dataPoints"`
+	Sessions   []UpdateResult `json:"sessions"`
+	Samples    []UpdateResult `json:"samples"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// Device is empty when the monitor only has one input
 type UpdateStatsRequest struct {
+	Device     string            `json:"device,omitempty"`
 	DataPoints []UpdateDataPoint `json:"dataPoints"`
+	Sessions   []UpdateSession   `json:"sessions,omitempty"`
+	Samples    []UpdateSample    `json:"samples,omitempty"`
 }
@@ -0,0 +1,251 @@
+package monitor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+const archiveMonthLayout = "2006-01"
+
+// Every data point is kept in monthly archive files next to the local DB, e.g.
+// godometer-archive-2026-10.txt, in the same format as the local DB. Past months
+// are compressed to e.g. godometer-archive-2026-09.txt.gz.
+type Archive struct {
+	dbPath string
+}
+
+func NewArchive(dbPath string) *Archive {
+	a := &Archive{}
+	a.dbPath = dbPath
+
+	return a
+}
+
+// Add new and updated data points to the file of their month
+func (a *Archive) Append(rows []FileDataPoint) error {
+	byMonth := map[string][]FileDataPoint{}
+	var months []string
+	for _, row := range rows {
+		ts, err := time.Parse(godometer.APITimeLayout, row.Timestamp)
+		if err != nil {
+			log.Printf("Not archiving data point with invalid timestamp %s", row.Timestamp)
+			continue
+		}
+
+		month := ts.Format(archiveMonthLayout)
+		if _, ok := byMonth[month]; !ok {
+			months = append(months, month)
+		}
+		byMonth[month] = append(byMonth[month], row)
+	}
+
+	for _, month := range months {
+		contents, err := formatRecords(byMonth[month])
+		if err != nil {
+			return err
+		}
+
+		if err := appendFileSync(archivePath(a.dbPath, month), contents); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Compress the files of months before the current one
+func (a *Archive) Rotate(now time.Time) {
+	current := now.In(utc).Format(archiveMonthLayout)
+	for _, month := range archiveMonths(a.dbPath, "") {
+		if month >= current {
+			continue
+		}
+
+		if err := a.compress(month); err != nil {
+			log.Printf("Could not compress archive for %s: %s", month, err)
+		}
+	}
+}
+
+func (a *Archive) compress(month string) error {
+	path := archivePath(a.dbPath, month)
+	gzPath := path + ".gz"
+
+	// Late updates can come after the month was compressed, those are merged in
+	rows, err := readArchiveFile(gzPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	newRows, err := readArchiveFile(path)
+	if err != nil {
+		return err
+	}
+
+	contents, err := formatRecords(latestDataPoints(rows, newRows))
+	if err != nil {
+		return err
+	}
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(contents); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(gzPath, compressed.Bytes()); err != nil {
+		return err
+	}
+
+	log.Printf("Compressed archive %s to %s", path, gzPath)
+	return os.Remove(path)
+}
+
+// Everything in the archive of the local DB at dbPath, oldest first
+func ReadArchive(dbPath string) ([]FileDataPoint, error) {
+	dataPoints := []FileDataPoint{}
+
+	// Uncompressed files have the latest updates, so they're read last
+	for _, suffix := range []string{".gz", ""} {
+		for _, month := range archiveMonths(dbPath, suffix) {
+			rows, err := readArchiveFile(archivePath(dbPath, month) + suffix)
+			if err != nil {
+				return nil, err
+			}
+
+			dataPoints = latestDataPoints(dataPoints, rows)
+		}
+	}
+
+	sort.Slice(dataPoints, func(i, j int) bool {
+		return dataPoints[i].Timestamp < dataPoints[j].Timestamp
+	})
+
+	return dataPoints, nil
+}
+
+// Meters traveled during the local day t is in, only reads the files of that day
+func (a *Archive) metersOn(t time.Time) float64 {
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	end := start.AddDate(0, 0, 1)
+
+	var dataPoints []FileDataPoint
+	months := []string{start.In(utc).Format(archiveMonthLayout)}
+	if last := end.Add(-time.Minute).In(utc).Format(archiveMonthLayout); last != months[0] {
+		months = append(months, last)
+	}
+
+	for _, month := range months {
+		for _, suffix := range []string{".gz", ""} {
+			rows, err := readArchiveFile(archivePath(a.dbPath, month) + suffix)
+			if err != nil {
+				if !os.IsNotExist(err) {
+					log.Printf("Could not read archive for %s: %s", month, err)
+				}
+				continue
+			}
+
+			dataPoints = latestDataPoints(dataPoints, rows)
+		}
+	}
+
+	meters := 0.0
+	for _, fdp := range dataPoints {
+		ts, err := time.ParseInLocation(godometer.APITimeLayout, fdp.Timestamp, utc)
+		if err != nil || ts.Before(start) || !ts.Before(end) {
+			continue
+		}
+		meters += float64(fdp.Meters)
+	}
+
+	return meters
+}
+
+func readArchiveFile(path string) ([]FileDataPoint, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Error closing %s: %s", path, err)
+		}
+	}()
+
+	var r io.Reader = file
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %s", path, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	dataPoints, _, err := readRecords(r, path)
+	return dataPoints, err
+}
+
+// Rows with later versions of the same data points replace the older ones
+func latestDataPoints(rows []FileDataPoint, later []FileDataPoint) []FileDataPoint {
+	positions := map[string]int{}
+	for i, row := range rows {
+		positions[row.Timestamp] = i
+	}
+
+	for _, row := range later {
+		if i, ok := positions[row.Timestamp]; ok {
+			rows[i] = row
+			continue
+		}
+
+		positions[row.Timestamp] = len(rows)
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// e.g. godometer.txt -> godometer-archive-2026-10.txt
+func archivePath(dbPath string, month string) string {
+	return siblingPath(dbPath, "archive-"+month)
+}
+
+// Months that have an archive file ending in suffix, oldest first
+func archiveMonths(dbPath string, suffix string) []string {
+	ext := filepath.Ext(dbPath)
+	prefix := strings.TrimSuffix(dbPath, ext) + "-archive-"
+
+	paths, err := filepath.Glob(prefix + "*" + ext + suffix)
+	if err != nil {
+		log.Printf("Could not list archive files: %s", err)
+		return nil
+	}
+
+	var months []string
+	for _, path := range paths {
+		month := strings.TrimSuffix(strings.TrimPrefix(path, prefix), ext+suffix)
+		if _, err := time.Parse(archiveMonthLayout, month); err != nil {
+			continue
+		}
+		months = append(months, month)
+	}
+
+	sort.Strings(months)
+	return months
+}
@@ -0,0 +1,54 @@
+package monitor
+
+import "sync"
+
+// Counts wheel revolutions for working out the wheel circumference. Add Record
+// as an observer to a Wheel.
+type RevolutionCounter struct {
+	pulsesPerRevolution int
+	pulses              int
+	counterMutex        *sync.Mutex
+}
+
+func NewRevolutionCounter(pulsesPerRevolution int) *RevolutionCounter {
+	if pulsesPerRevolution < 1 {
+		pulsesPerRevolution = 1
+	}
+
+	rc := &RevolutionCounter{}
+	rc.pulsesPerRevolution = pulsesPerRevolution
+	rc.counterMutex = &sync.Mutex{}
+
+	return rc
+}
+
+func (rc *RevolutionCounter) Record(p Pulse, status PulseStatus) {
+	if p.Channel != PrimaryChannel || p.Edge != RisingEdge {
+		return
+	}
+
+	// The first pulse after a pause doesn't add distance in the stats, but the
+	// wheel did still turn
+	if status != PulseAccepted && status != PulseTooSlow {
+		return
+	}
+
+	rc.counterMutex.Lock()
+	defer rc.counterMutex.Unlock()
+
+	rc.pulses += 1
+}
+
+func (rc *RevolutionCounter) Reset() {
+	rc.counterMutex.Lock()
+	defer rc.counterMutex.Unlock()
+
+	rc.pulses = 0
+}
+
+func (rc *RevolutionCounter) Revolutions() float64 {
+	rc.counterMutex.Lock()
+	defer rc.counterMutex.Unlock()
+
+	return float64(rc.pulses) / float64(rc.pulsesPerRevolution)
+}
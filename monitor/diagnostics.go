@@ -0,0 +1,170 @@
+package monitor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Upper limits of the pulse interval histogram buckets, the last bucket has everything longer
+var intervalBuckets = []time.Duration{
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1000 * time.Millisecond,
+	2000 * time.Millisecond,
+}
+
+// Noise levels for the verdict, as fraction of all edges that had to be ignored
+const (
+	goodNoiseLevel = 0.01
+	fairNoiseLevel = 0.10
+)
+
+// Collects statistics on the signal quality of a sensor. Add Record as an
+// observer to a Wheel and read the results with Report.
+type Diagnostics struct {
+	started    time.Time
+	firstPulse time.Time
+	lastPulse  time.Time
+	lastRising time.Time
+	edges      int
+	statuses   map[PulseStatus]int
+	intervals  []int
+	statsMutex *sync.Mutex
+}
+
+type IntervalBucket struct {
+	Label string
+	Count int
+}
+
+type DiagnosticsReport struct {
+	Duration   time.Duration
+	Edges      int
+	Accepted   int
+	TooFast    int
+	TooSlow    int
+	SameEdge   int
+	Rejected   int
+	Intervals  []IntervalBucket
+	NoiseLevel float64
+	Verdict    string
+	Hints      []string
+}
+
+func NewDiagnostics() *Diagnostics {
+	d := &Diagnostics{}
+	d.started = time.Now()
+	d.statuses = map[PulseStatus]int{}
+	d.intervals = make([]int, len(intervalBuckets)+1)
+	d.statsMutex = &sync.Mutex{}
+
+	return d
+}
+
+func intervalBucket(interval time.Duration) int {
+	for i, limit := range intervalBuckets {
+		if interval < limit {
+			return i
+		}
+	}
+
+	return len(intervalBuckets)
+}
+
+func (d *Diagnostics) Record(p Pulse, status PulseStatus) {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	if p.Channel != PrimaryChannel {
+		return
+	}
+
+	d.edges += 1
+	d.statuses[status] += 1
+	if d.firstPulse.IsZero() {
+		d.firstPulse = p.Time
+	}
+	d.lastPulse = p.Time
+
+	// Raw intervals including the noise, to see what the sensor is really sending
+	if p.Edge == RisingEdge {
+		if !d.lastRising.IsZero() {
+			d.intervals[intervalBucket(p.Time.Sub(d.lastRising))] += 1
+		}
+		d.lastRising = p.Time
+	}
+}
+
+func bucketLabel(i int) string {
+	if i == 0 {
+		return fmt.Sprintf("< %s", intervalBuckets[0])
+	} else if i == len(intervalBuckets) {
+		return fmt.Sprintf(">= %s", intervalBuckets[i-1])
+	}
+	return fmt.Sprintf("%s - %s", intervalBuckets[i-1], intervalBuckets[i])
+}
+
+func (d *Diagnostics) Report() DiagnosticsReport {
+	d.statsMutex.Lock()
+	defer d.statsMutex.Unlock()
+
+	// Pulse timestamps are also right for replayed pulse logs
+	duration := time.Since(d.started)
+	if d.edges > 1 {
+		duration = d.lastPulse.Sub(d.firstPulse)
+	}
+
+	r := DiagnosticsReport{
+		Duration: duration,
+		Edges:    d.edges,
+		Accepted: d.statuses[PulseAccepted] + d.statuses[PulseBackward],
+		TooFast:  d.statuses[PulseTooFast],
+		TooSlow:  d.statuses[PulseTooSlow],
+		SameEdge: d.statuses[PulseSameEdge],
+		Rejected: d.statuses[PulseImplausible],
+	}
+
+	for i, count := range d.intervals {
+		r.Intervals = append(r.Intervals, IntervalBucket{Label: bucketLabel(i), Count: count})
+	}
+
+	// Pauses are normal, everything else ignored is noise
+	noise := r.TooFast + r.SameEdge + r.Rejected
+	if r.Edges > 0 {
+		r.NoiseLevel = float64(noise) / float64(r.Edges)
+	}
+
+	switch {
+	case r.Edges == 0:
+		r.Verdict = "No signal"
+		r.Hints = append(r.Hints, "No pulses at all, check the wiring, pin and bias settings, and that the wheel was turning.")
+	case r.Accepted == 0:
+		r.Verdict = "Unusable"
+		r.Hints = append(r.Hints, "Pulses were seen but none of them were accepted, check the speed range settings and turn the wheel steadily.")
+	case r.NoiseLevel < goodNoiseLevel:
+		r.Verdict = "Good"
+	case r.NoiseLevel < fairNoiseLevel:
+		r.Verdict = "Fair"
+	default:
+		r.Verdict = "Poor"
+	}
+
+	if r.NoiseLevel >= goodNoiseLevel {
+		if r.TooFast >= r.SameEdge {
+			r.Hints = append(r.Hints, "Mostly too fast edges, the sensor is flapping. Try moving the magnet closer, a kernel -debounce or a different -bias.")
+		} else {
+			r.Hints = append(r.Hints, "Mostly repeated edges, some edges are getting lost. Check the wiring and try a different -bias.")
+		}
+	}
+
+	if r.Rejected > 0 {
+		r.Hints = append(r.Hints, "Some pulses implied impossible acceleration, likely extra pulses from noise.")
+	}
+
+	return r
+}
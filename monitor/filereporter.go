@@ -0,0 +1,176 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var csvHeader = []string{"device", "ts", "m", "mps", "kph", "tm", "mv", "id"}
+
+// One line of a JSON lines report, only one of the things is set
+type ReportLine struct {
+	Device    string         `json:"device,omitempty"`
+	DataPoint *FileDataPoint `json:"dp,omitempty"`
+	Session   *FileSession   `json:"session,omitempty"`
+	Sample    *FileSample    `json:"sample,omitempty"`
+}
+
+// Writes reports to a file or e.g. stdout, either as JSON lines with everything or as CSV
+// with only the data points. Updated data points are written again with the same
+// timestamp, the last one is the right one.
+type FileReporter struct {
+	name   string
+	path   string
+	writer io.Writer
+	format string
+	// Shared by all the inputs, so writes need mutexing
+	mutex         *sync.Mutex
+	headerWritten bool
+}
+
+// Format is csv or jsonl, or empty to pick by the extension of path
+func NewFileReporter(path string, format string) (*FileReporter, error) {
+	if format == "" {
+		format = "jsonl"
+		if strings.ToLower(filepath.Ext(path)) == ".csv" {
+			format = "csv"
+		}
+	}
+
+	fr, err := newFileReporter("file "+path, format)
+	if err != nil {
+		return nil, err
+	}
+	fr.path = path
+
+	return fr, nil
+}
+
+// Writes to w instead of a file, e.g. os.Stdout
+func NewWriterReporter(name string, w io.Writer, format string) (*FileReporter, error) {
+	fr, err := newFileReporter(name, format)
+	if err != nil {
+		return nil, err
+	}
+	fr.writer = w
+
+	return fr, nil
+}
+
+func newFileReporter(name string, format string) (*FileReporter, error) {
+	if format != "csv" && format != "jsonl" {
+		return nil, fmt.Errorf("unknown format %q, expected csv or jsonl", format)
+	}
+
+	fr := &FileReporter{}
+	fr.name = name
+	fr.format = format
+	fr.mutex = &sync.Mutex{}
+
+	return fr, nil
+}
+
+func (fr *FileReporter) Name() string {
+	return fr.name
+}
+
+func (fr *FileReporter) Report(device string, report StatsReport) error {
+	fr.mutex.Lock()
+	defer fr.mutex.Unlock()
+
+	header := false
+	if fr.format == "csv" {
+		header = !fr.headerWritten
+		if fr.path != "" {
+			// Continue an existing file without repeating the header
+			info, err := os.Stat(fr.path)
+			header = err != nil || info.Size() == 0
+		}
+	}
+
+	var data []byte
+	var err error
+	if fr.format == "csv" {
+		data, err = formatReportCSV(device, report, header)
+	} else {
+		data, err = formatReportJSONL(device, report)
+	}
+
+	if err != nil || len(data) == 0 {
+		return err
+	}
+
+	if fr.path != "" {
+		err = appendFileSync(fr.path, data)
+	} else {
+		_, err = fr.writer.Write(data)
+	}
+
+	if err == nil && header {
+		fr.headerWritten = true
+	}
+
+	return err
+}
+
+func formatReportCSV(device string, report StatsReport, header bool) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if header && len(report.DataPoints) > 0 {
+		_ = w.Write(csvHeader)
+	}
+
+	for _, fdp := range report.DataPoints {
+		_ = w.Write([]string{
+			device,
+			fdp.Timestamp,
+			formatFloat32(fdp.Meters),
+			formatFloat32(fdp.MetersPerSecond),
+			formatFloat32(fdp.KilometersPerHour),
+			strconv.FormatFloat(fdp.TotalMeters, 'f', -1, 64),
+			formatFloat32(fdp.MovingSeconds),
+			formatFloat32(fdp.IdleSeconds),
+		})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func formatReportJSONL(device string, report StatsReport) ([]byte, error) {
+	var lines []ReportLine
+	for i := range report.DataPoints {
+		lines = append(lines, ReportLine{Device: device, DataPoint: &report.DataPoints[i]})
+	}
+	for i := range report.Sessions {
+		lines = append(lines, ReportLine{Device: device, Session: &report.Sessions[i]})
+	}
+	for i := range report.Samples {
+		lines = append(lines, ReportLine{Device: device, Sample: &report.Samples[i]})
+	}
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.Write(data)
+		buf.WriteString("\n")
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatFloat32(f float32) string {
+	return strconv.FormatFloat(float64(f), 'f', -1, 32)
+}
@@ -0,0 +1,49 @@
+package monitor
+
+import "time"
+
+// Allow this much speed change between pulses on top of MaxAcceleration, as the
+// pulse timing is never perfectly even
+const speedTolerance = 0.25
+
+// Decides which pulses are believable based on the range of speeds to expect and
+// how quickly the speed can change. Suitable limits depend on the wheel size and
+// what is being measured, e.g. a treadmill or an exercise bike.
+type GlitchFilter struct {
+	MinKilometersPerHour float64
+	MaxKilometersPerHour float64
+	// In m/s², pulses implying faster speed increases are ignored. 0 to disable.
+	MaxAcceleration float64
+}
+
+// Matches the limits originally tuned for a 0.2375m wheel on a treadmill
+func DefaultGlitchFilter() GlitchFilter {
+	return GlitchFilter{
+		MinKilometersPerHour: 0.5,
+		MaxKilometersPerHour: 21.5,
+		MaxAcceleration:      3.0,
+	}
+}
+
+func kphToMPS(kph float64) float64 {
+	return kph * 1000.0 / 3600.0
+}
+
+// Shortest and longest time between edges for the given distance per pulse
+func (gf GlitchFilter) limits(metersPerPulse float64) (time.Duration, time.Duration) {
+	minElapsed := time.Duration(metersPerPulse / kphToMPS(gf.MaxKilometersPerHour) * float64(time.Second))
+	maxElapsed := time.Duration(metersPerPulse / kphToMPS(gf.MinKilometersPerHour) * float64(time.Second))
+
+	return minElapsed, maxElapsed
+}
+
+// Whether going from previousMPS to mps in elapsed time is physically possible
+func (gf GlitchFilter) plausible(previousMPS float64, mps float64, elapsed time.Duration) bool {
+	if gf.MaxAcceleration <= 0 || previousMPS <= 0 || mps <= previousMPS {
+		// Slowing down is always fine, missed pulses look like that too
+		return true
+	}
+
+	allowed := previousMPS*speedTolerance + gf.MaxAcceleration*elapsed.Seconds()
+	return mps-previousMPS <= allowed
+}
@@ -0,0 +1,47 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGlitchFilterLimits(t *testing.T) {
+	gf := GlitchFilter{MinKilometersPerHour: 0.36, MaxKilometersPerHour: 36}
+	minElapsed, maxElapsed := gf.limits(1)
+
+	if minElapsed != 100*time.Millisecond {
+		t.Errorf("expected 100ms at 10m/s, got %s", minElapsed)
+	}
+	if maxElapsed != 10*time.Second {
+		t.Errorf("expected 10s at 0.1m/s, got %s", maxElapsed)
+	}
+}
+
+func TestGlitchFilterPlausible(t *testing.T) {
+	gf := DefaultGlitchFilter()
+	tests := []struct {
+		name      string
+		previous  float64
+		mps       float64
+		elapsed   time.Duration
+		plausible bool
+	}{
+		{"first pulse", 0, 5, 100 * time.Millisecond, true},
+		{"slowing down", 5, 1, 100 * time.Millisecond, true},
+		{"within tolerance", 2, 2.4, 10 * time.Millisecond, true},
+		{"accelerating", 1, 1.5, 100 * time.Millisecond, true},
+		{"too fast", 1, 2, 100 * time.Millisecond, false},
+		{"slowly accelerating", 1, 2, time.Second, true},
+	}
+
+	for _, test := range tests {
+		if got := gf.plausible(test.previous, test.mps, test.elapsed); got != test.plausible {
+			t.Errorf("%s: expected %v, got %v", test.name, test.plausible, got)
+		}
+	}
+
+	gf.MaxAcceleration = 0
+	if !gf.plausible(1, 10, 10*time.Millisecond) {
+		t.Errorf("expected anything to be plausible without an acceleration limit")
+	}
+}
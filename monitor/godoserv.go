@@ -0,0 +1,145 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+// Sends batches to the updateStats API of godoserv
+type GodoservSender struct {
+	apiBaseUrl string
+	apiAuth    string
+	client     http.Client
+}
+
+func NewGodoservSender(apiBaseUrl string, apiAuth string) *GodoservSender {
+	gs := &GodoservSender{}
+	gs.apiBaseUrl = apiBaseUrl
+	gs.apiAuth = apiAuth
+	gs.client = http.Client{Timeout: 10 * time.Second}
+
+	return gs
+}
+
+// Reports to godoserv through an outbox next to the local DB
+func NewGodoservReporter(dbPath string, apiBaseUrl string, apiAuth string) *OutboxReporter {
+	return NewOutboxReporter(siblingPath(dbPath, "outbox"), NewGodoservSender(apiBaseUrl, apiAuth))
+}
+
+func (gs *GodoservSender) Name() string {
+	return "godoserv " + gs.apiBaseUrl
+}
+
+// Returns the part of the batch the server handled, things it rejected are logged and
+// count as handled as they will never be accepted
+func (gs *GodoservSender) Send(device string, batch OutboxBatch) (OutboxBatch, error) {
+	var adps []godometer.UpdateDataPoint
+	for _, fdp := range batch.DataPoints {
+		adps = append(adps, fdp.toAPIDataPoint())
+	}
+
+	var sessions []godometer.UpdateSession
+	for _, fs := range batch.Sessions {
+		sessions = append(sessions, fs.toAPISession())
+	}
+
+	var samples []godometer.UpdateSample
+	for _, fs := range batch.Samples {
+		samples = append(samples, fs.toAPISample())
+	}
+
+	payload := godometer.UpdateStatsRequest{Device: device, DataPoints: adps, Sessions: sessions, Samples: samples}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxBatch{}, fmt.Errorf("failed to marshal request POST data: %s", err)
+	}
+
+	url := fmt.Sprintf("%s/api/v1/updateStats", gs.apiBaseUrl)
+	request, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return OutboxBatch{}, fmt.Errorf("failed to initialize POST request: %s", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", gs.apiAuth)
+
+	resp, err := gs.client.Do(request)
+	if err != nil {
+		return OutboxBatch{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	result := godometer.UpdateStatsResponse{}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err == nil && len(respBody) > 0 {
+		err = json.Unmarshal(respBody, &result)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return OutboxBatch{}, fmt.Errorf("API returned status %d. This is likely not a good sign. %s", resp.StatusCode, result.Error)
+	}
+
+	// Older servers don't say anything, then everything was accepted
+	if err != nil || len(respBody) == 0 {
+		if statsDebug {
+			log.Printf("Updated %d dataPoints, %d sessions and %d samples to %s", len(adps), len(sessions), len(samples), url)
+		}
+		return batch, nil
+	}
+
+	handled := OutboxBatch{}
+	for _, fdp := range batch.DataPoints {
+		if r, ok := findResult(result.DataPoints, fdp.Timestamp); ok {
+			logResult("data point", r)
+			handled.DataPoints = append(handled.DataPoints, fdp)
+		}
+	}
+
+	for _, fs := range batch.Sessions {
+		if r, ok := findResult(result.Sessions, fs.Start); ok {
+			logResult("session", r)
+			handled.Sessions = append(handled.Sessions, fs)
+		}
+	}
+
+	for _, fs := range batch.Samples {
+		if r, ok := findResult(result.Samples, fs.Timestamp); ok {
+			logResult("sample", r)
+			handled.Samples = append(handled.Samples, fs)
+		}
+	}
+
+	if statsDebug {
+		log.Printf("Server handled %d/%d dataPoints, %d/%d sessions and %d/%d samples at %s",
+			len(handled.DataPoints), len(adps), len(handled.Sessions), len(sessions), len(handled.Samples), len(samples), url)
+	}
+
+	return handled, nil
+}
+
+func findResult(results []godometer.UpdateResult, key string) (godometer.UpdateResult, bool) {
+	for _, r := range results {
+		if r.Key == key {
+			return r, true
+		}
+	}
+	return godometer.UpdateResult{}, false
+}
+
+// Rejected things will never be accepted, so they're only logged and dropped
+func logResult(kind string, r godometer.UpdateResult) {
+	if r.Status == godometer.UpdateRejected {
+		log.Printf("Server rejected %s %s: %s", kind, r.Key, r.Reason)
+	} else if statsDebug && r.Status == godometer.UpdateDuplicate {
+		log.Printf("Server already had %s %s", kind, r.Key)
+	}
+}
@@ -1,6 +1,10 @@
+//go:build linux
+// +build linux
+
 package monitor
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"sync"
@@ -10,104 +14,150 @@ import (
 	"github.com/warthog618/gpiod"
 )
 
-// These chosen based on min and max speeds to monitor and circumference of monitoring wheel
-const (
-	minElapsed = 40 * time.Millisecond   // 25x per second, so max 0.24*25 = 6m/s or 21.5km/h
-	maxElapsed = 1500 * time.Millisecond // 0.66x per second, or 0.24 * 0.66 = 0.16m/s or 0.57km/h
-)
+// Longest wait between attempts to open the chip and lines
+const maxGPIORetryInterval = time.Minute
 
-type GPIORecord struct {
-	Meters            float64
-	MetersPerSecond   float64
-	KilometersPerHour float64
-}
+// How often to check the chip is still there, e.g. after a USB GPIO adapter is unplugged
+const gpioCheckInterval = 5 * time.Second
 
 type GPIOMonitor struct {
-	device                   string
-	pin                      int
-	wheelCircumferenceMeters float64
-	metersTraveled           float64
-	lastRead                 time.Time
-	lastValue                gpiod.LineEventType
-	handlerMutex             *sync.Mutex
-	results                  chan GPIORecord
+	device       string
+	pin          int
+	directionPin int
+	options      GPIOLineOptions
+	opened       uint64
+	errors       uint64
+	countersLock *sync.Mutex
 }
 
-func NewGPIOMonitor(device string, pin int, wheelCircumferenceMeters float64, results chan GPIORecord) *GPIOMonitor {
+// Set directionPin to -1 when there is no second sensor for direction detection
+func NewGPIOMonitor(device string, pin int, directionPin int, options GPIOLineOptions) *GPIOMonitor {
 	gm := &GPIOMonitor{}
 	gm.device = device
 	gm.pin = pin
-	gm.wheelCircumferenceMeters = wheelCircumferenceMeters
-	gm.metersTraveled = 0.0
-	gm.lastValue = gpiod.LineEventFallingEdge
-	gm.results = results
-	gm.handlerMutex = &sync.Mutex{}
+	gm.directionPin = directionPin
+	gm.options = options
+	gm.countersLock = &sync.Mutex{}
 
 	return gm
 }
 
-func metersPerSecond(elapsed time.Duration, circumferenceMeters float64) float64 {
-	elapsedMillis := float64(elapsed) / float64(time.Millisecond)
-	toSeconds := 1000.0 / elapsedMillis
+func (gm *GPIOMonitor) lineOptions(c *gpiod.Chip, lineHandler func(gpiod.LineEvent)) []gpiod.LineReqOption {
+	options := []gpiod.LineReqOption{gpiod.AsInput, gpiod.WithBothEdges, gpiod.WithEventHandler(lineHandler)}
+
+	switch gm.options.Bias {
+	case BiasPullUp:
+		options = append(options, gpiod.WithPullUp)
+	case BiasPullDown:
+		options = append(options, gpiod.WithPullDown)
+	case BiasDisabled:
+		options = append(options, gpiod.WithBiasDisabled)
+	}
+
+	if gm.options.ActiveLow {
+		options = append(options, gpiod.AsActiveLow)
+	}
+
+	if gm.options.Debounce > 0 {
+		if c.UapiAbiVersion() >= 2 {
+			options = append(options, gpiod.WithDebounce(gm.options.Debounce))
+		} else {
+			log.Printf("Kernel debounce requires Linux v5.10 or later, ignoring debounce setting for chip %s", gm.device)
+		}
+	}
 
-	return toSeconds * circumferenceMeters
+	return options
 }
 
-func (gm *GPIOMonitor) handler(evt gpiod.LineEvent) {
-	gm.handlerMutex.Lock()
-	defer gm.handlerMutex.Unlock()
-
-	now := time.Now()
-	elapsed := now.Sub(gm.lastRead)
-	value := evt.Type
-
-	if gm.lastRead.IsZero() || elapsed > maxElapsed {
-		// Reset counting whenever we've been paused for a little while
-		gm.lastRead = now
-		gm.lastValue = value
-		return
-	} else {
-		// Too fast updates - some sort of flapping likely going on
-		if elapsed < minElapsed {
-			// fmt.Printf("-")
-			return
+func (gm *GPIOMonitor) requestLine(c *gpiod.Chip, pin int, channel int, handler PulseHandler) (*gpiod.Line, error) {
+	lineHandler := func(evt gpiod.LineEvent) {
+		edge := FallingEdge
+		if evt.Type == gpiod.LineEventRisingEdge {
+			edge = RisingEdge
 		}
+
+		// Wheel counts rising edges, so swap them around when counting falling ones. The
+		// direction line always reports its actual level.
+		if channel == PrimaryChannel && gm.options.CountEdge == FallingEdge {
+			if edge == RisingEdge {
+				edge = FallingEdge
+			} else {
+				edge = RisingEdge
+			}
+		}
+
+		handler(Pulse{Time: time.Now(), Edge: edge, Channel: channel})
+	}
+
+	l, err := c.RequestLine(pin, gm.lineOptions(c, lineHandler)...)
+	if err != nil {
+		if err == syscall.Errno(22) && gm.options.Bias != BiasAsIs {
+			return nil, fmt.Errorf("error opening pin %d: %s. Note that the bias option requires kernel V5.5 or later - check your kernel version", pin, err)
+		}
+		return nil, fmt.Errorf("error opening pin %d: %s", pin, err)
+	}
+
+	return l, nil
+}
+
+func (gm *GPIOMonitor) closeLine(l *gpiod.Line) {
+	err := l.Close()
+	if err != nil {
+		log.Printf("Error closing chip %s pin %d: %s", gm.device, l.Offset(), err)
 	}
+}
 
-	// Same values being sent repeatedly - junk data
-	if value == gm.lastValue {
-		// fmt.Printf(".")
-		return
+// How many times the lines have been opened, and how many times opening them failed or
+// they stopped working
+func (gm *GPIOMonitor) Counters() map[string]uint64 {
+	gm.countersLock.Lock()
+	defer gm.countersLock.Unlock()
+
+	return map[string]uint64{
+		"lineOpens":  gm.opened,
+		"lineErrors": gm.errors,
 	}
+}
 
-	gm.lastRead = now
-	gm.lastValue = value
+// Feed pulses to handler until ctx is done. If the chip or the lines can't be opened,
+// or the chip goes away, they're opened again with a growing delay.
+func (gm *GPIOMonitor) Monitor(ctx context.Context, handler PulseHandler) error {
+	delay := time.Second
+	for {
+		opened, err := gm.monitorChip(ctx, handler)
+		if ctx.Err() != nil {
+			return nil
+		}
 
-	if value == gpiod.LineEventRisingEdge {
-		mps := metersPerSecond(elapsed, gm.wheelCircumferenceMeters)
-		kph := mps * 3600.0 / 1000.0 // 3600s/h & 1000m/km
+		gm.countersLock.Lock()
+		gm.errors++
+		gm.countersLock.Unlock()
 
-		result := GPIORecord{
-			Meters:            gm.wheelCircumferenceMeters,
-			MetersPerSecond:   mps,
-			KilometersPerHour: kph,
+		if opened {
+			// Worked for a while, so start over with a short delay
+			delay = time.Second
 		}
 
+		log.Printf("GPIO chip %s failed: %s. Trying again in %s.", gm.device, err, delay)
 		select {
-		case gm.results <- result:
-		default:
-			log.Panic("Results buffer is full, something is very wrong!")
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil
+		}
+
+		delay *= 2
+		if delay > maxGPIORetryInterval {
+			delay = maxGPIORetryInterval
 		}
 	}
 }
 
-func (gm *GPIOMonitor) Monitor(exit chan bool) {
-	// TODO: Report zero when not moving to make CLI output nicer
-	// ... has minimal benefit for API usage, might actually make it worse
-
+// Open the chip and lines and wait until ctx is done or the chip stops working. Returns
+// whether the lines were opened.
+func (gm *GPIOMonitor) monitorChip(ctx context.Context, handler PulseHandler) (bool, error) {
 	c, err := gpiod.NewChip(gm.device)
 	if err != nil {
-		log.Panicf("Error opening chip %s: %s", gm.device, err)
+		return false, err
 	}
 	defer func() {
 		err := c.Close()
@@ -116,20 +166,39 @@ func (gm *GPIOMonitor) Monitor(exit chan bool) {
 		}
 	}()
 
-	l, err := c.RequestLine(gm.pin, gpiod.AsInput, gpiod.WithBothEdges(gm.handler))
+	l, err := gm.requestLine(c, gm.pin, PrimaryChannel, handler)
 	if err != nil {
-		if err == syscall.Errno(22) {
-			fmt.Println("Note that the WithPull* option requires kernel V5.5 or later - check your kernel version.")
-		}
-		log.Panicf("Error opening chip %s pin %d: %s", gm.device, gm.pin, err)
+		return false, err
 	}
+	defer gm.closeLine(l)
 
-	defer func() {
-		err := l.Close()
+	if gm.directionPin >= 0 {
+		dl, err := gm.requestLine(c, gm.directionPin, DirectionChannel, handler)
 		if err != nil {
-			log.Printf("Error closing chip %s pin %s: %s", gm.device, gm.pin, err)
+			return false, err
 		}
-	}()
+		defer gm.closeLine(dl)
+	}
+
+	gm.countersLock.Lock()
+	if gm.opened > 0 {
+		log.Printf("Opened chip %s pin %d again", gm.device, gm.pin)
+	}
+	gm.opened++
+	gm.countersLock.Unlock()
 
-	<-exit
+	check := time.NewTicker(gpioCheckInterval)
+	defer check.Stop()
+
+	for {
+		select {
+		case <-check.C:
+			if _, err := c.LineInfo(gm.pin); err != nil {
+				return true, fmt.Errorf("lost pin %d: %s", gm.pin, err)
+			}
+
+		case <-ctx.Done():
+			return true, nil
+		}
+	}
 }
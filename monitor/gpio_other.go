@@ -0,0 +1,36 @@
+//go:build !linux
+// +build !linux
+
+package monitor
+
+import (
+	"context"
+	"fmt"
+)
+
+// GPIO access via gpiod is only possible on Linux, this allows building the
+// rest of the package elsewhere for development with e.g. SimulatedSource
+type GPIOMonitor struct {
+	device       string
+	pin          int
+	directionPin int
+	options      GPIOLineOptions
+}
+
+func NewGPIOMonitor(device string, pin int, directionPin int, options GPIOLineOptions) *GPIOMonitor {
+	gm := &GPIOMonitor{}
+	gm.device = device
+	gm.pin = pin
+	gm.directionPin = directionPin
+	gm.options = options
+
+	return gm
+}
+
+func (gm *GPIOMonitor) Counters() map[string]uint64 {
+	return map[string]uint64{}
+}
+
+func (gm *GPIOMonitor) Monitor(ctx context.Context, handler PulseHandler) error {
+	return fmt.Errorf("can not monitor %s pin %d, GPIO is only supported on Linux", gm.device, gm.pin)
+}
@@ -0,0 +1,133 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+// Totals over a day, week, month or any other range of time
+type PeriodSummary struct {
+	Label                string
+	Start                time.Time
+	Meters               float64
+	MovingSeconds        float64
+	MaxKilometersPerHour float32
+	ActiveDays           int
+	activeDays           map[string]bool
+}
+
+func newPeriodSummary(label string, start time.Time) *PeriodSummary {
+	ps := &PeriodSummary{}
+	ps.Label = label
+	ps.Start = start
+	ps.activeDays = map[string]bool{}
+
+	return ps
+}
+
+// Average speed while moving
+func (ps PeriodSummary) KilometersPerHour() float64 {
+	if ps.MovingSeconds <= 0 {
+		return 0.0
+	}
+	return ps.Meters / ps.MovingSeconds * 3.6
+}
+
+// Average distance on the days with any movement
+func (ps PeriodSummary) MetersPerActiveDay() float64 {
+	if ps.ActiveDays == 0 {
+		return 0.0
+	}
+	return ps.Meters / float64(ps.ActiveDays)
+}
+
+func (ps *PeriodSummary) add(fdp FileDataPoint, local time.Time) {
+	ps.Meters += float64(fdp.Meters)
+	ps.MovingSeconds += float64(fdp.MovingSeconds)
+	if fdp.KilometersPerHour > ps.MaxKilometersPerHour {
+		ps.MaxKilometersPerHour = fdp.KilometersPerHour
+	}
+
+	if fdp.Meters > 0 {
+		ps.activeDays[local.Format(dayLayout)] = true
+		ps.ActiveDays = len(ps.activeDays)
+	}
+}
+
+// Start of the day, week or month t is in, and a label for it. Weeks start on Monday.
+func periodStart(t time.Time, period string) (time.Time, string, error) {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+
+	switch period {
+	case "day":
+		return day, day.Format(dayLayout), nil
+	case "week":
+		start := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		year, week := start.ISOWeek()
+		return start, fmt.Sprintf("%d-W%02d", year, week), nil
+	case "month":
+		start := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+		return start, start.Format("2006-01"), nil
+	}
+
+	return time.Time{}, "", fmt.Errorf("unknown period %q, expected day, week or month", period)
+}
+
+// Totals for every day, week or month in loc that had any movement, oldest first
+func Summarize(dataPoints []FileDataPoint, period string, loc *time.Location) ([]PeriodSummary, error) {
+	if _, _, err := periodStart(time.Now(), period); err != nil {
+		return nil, err
+	}
+
+	var summaries []*PeriodSummary
+	for _, fdp := range dataPoints {
+		ts, err := time.ParseInLocation(godometer.APITimeLayout, fdp.Timestamp, utc)
+		if err != nil {
+			continue
+		}
+
+		local := ts.In(loc)
+		start, label, _ := periodStart(local, period)
+		if len(summaries) == 0 || !summaries[len(summaries)-1].Start.Equal(start) {
+			summaries = append(summaries, newPeriodSummary(label, start))
+		}
+
+		summaries[len(summaries)-1].add(fdp, local)
+	}
+
+	result := []PeriodSummary{}
+	for _, ps := range summaries {
+		if ps.Meters > 0 {
+			result = append(result, *ps)
+		}
+	}
+
+	return result, nil
+}
+
+// Totals from the start of the day, week or month that now is in, or everything if
+// period is empty
+func SummarizeSince(dataPoints []FileDataPoint, period string, label string, now time.Time) (PeriodSummary, error) {
+	from := time.Time{}
+	if period != "" {
+		start, _, err := periodStart(now, period)
+		if err != nil {
+			return PeriodSummary{}, err
+		}
+		from = start
+	}
+
+	ps := newPeriodSummary(label, from)
+	for _, fdp := range dataPoints {
+		ts, err := time.ParseInLocation(godometer.APITimeLayout, fdp.Timestamp, utc)
+		if err != nil || ts.Before(from) {
+			continue
+		}
+
+		ps.add(fdp, ts.In(now.Location()))
+	}
+
+	return *ps, nil
+}
@@ -0,0 +1,135 @@
+package monitor
+
+import (
+	"encoding/json"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Home Assistant only allows these in the node and object IDs of discovery topics
+var discoveryIDCleaner = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// Identifies this monitor to Home Assistant, all inputs are entities of the same device
+type DiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+// Home Assistant MQTT discovery config of a sensor or a binary sensor
+type DiscoveryConfig struct {
+	Name                string          `json:"name"`
+	UniqueID            string          `json:"unique_id"`
+	StateTopic          string          `json:"state_topic"`
+	ValueTemplate       string          `json:"value_template"`
+	DeviceClass         string          `json:"device_class,omitempty"`
+	StateClass          string          `json:"state_class,omitempty"`
+	UnitOfMeasurement   string          `json:"unit_of_measurement,omitempty"`
+	Icon                string          `json:"icon,omitempty"`
+	AvailabilityTopic   string          `json:"availability_topic"`
+	PayloadAvailable    string          `json:"payload_available"`
+	PayloadNotAvailable string          `json:"payload_not_available"`
+	Device              DiscoveryDevice `json:"device"`
+}
+
+type discoveryEntity struct {
+	component string
+	object    string
+	config    DiscoveryConfig
+}
+
+func (r *MQTTReporter) discoveryEntities(device string) []discoveryEntity {
+	name := "Treadmill"
+	if device != "" {
+		name = "Treadmill " + device
+	}
+
+	return []discoveryEntity{
+		{"sensor", "speed", DiscoveryConfig{
+			Name:              name + " speed",
+			StateTopic:        r.topic(device, "speed"),
+			ValueTemplate:     "{{ value_json.kph | round(1) }}",
+			DeviceClass:       "speed",
+			StateClass:        "measurement",
+			UnitOfMeasurement: "km/h",
+		}},
+		{"sensor", "today", DiscoveryConfig{
+			Name:              name + " distance today",
+			StateTopic:        r.topic(device, "today"),
+			ValueTemplate:     "{{ (value_json.m / 1000) | round(3) }}",
+			DeviceClass:       "distance",
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: "km",
+		}},
+		{"sensor", "odometer", DiscoveryConfig{
+			Name:              name + " odometer",
+			StateTopic:        r.topic(device, "odometer"),
+			ValueTemplate:     "{{ (value_json.tm / 1000) | round(3) }}",
+			DeviceClass:       "distance",
+			StateClass:        "total_increasing",
+			UnitOfMeasurement: "km",
+			Icon:              "mdi:counter",
+		}},
+		{"binary_sensor", "moving", DiscoveryConfig{
+			Name:          name + " moving",
+			StateTopic:    r.topic(device, "speed"),
+			ValueTemplate: "{{ 'ON' if value_json.moving else 'OFF' }}",
+			DeviceClass:   "moving",
+		}},
+		{"sensor", "last_report", DiscoveryConfig{
+			Name:          name + " last report",
+			StateTopic:    r.topic(device, "report"),
+			ValueTemplate: "{{ value_json.ts }}",
+			DeviceClass:   "timestamp",
+			Icon:          "mdi:cloud-upload",
+		}},
+	}
+}
+
+// Publish the configs that make Home Assistant pick up the entities of an input by itself.
+// They're always retained, so Home Assistant finds them after restarting too.
+func (r *MQTTReporter) publishDiscovery(device string) {
+	if !r.client.IsConnected() {
+		// Published when connecting
+		return
+	}
+
+	node := discoveryIDCleaner.ReplaceAllString(r.options.ClientID, "_")
+	dd := DiscoveryDevice{
+		Identifiers:  []string{node},
+		Name:         "Godometer " + r.options.ClientID,
+		Manufacturer: "godometer",
+		Model:        "Treadmill odometer",
+	}
+
+	for _, entity := range r.discoveryEntities(device) {
+		object := entity.object
+		if device != "" {
+			object = discoveryIDCleaner.ReplaceAllString(device, "_") + "_" + object
+		}
+
+		config := entity.config
+		config.UniqueID = node + "_" + object
+		config.AvailabilityTopic = r.topic("", "status")
+		config.PayloadAvailable = "online"
+		config.PayloadNotAvailable = "offline"
+		config.Device = dd
+
+		data, err := json.Marshal(config)
+		if err != nil {
+			log.Printf("Could not marshal discovery config for %s: %s. This should not happen.", object, err)
+			continue
+		}
+
+		topic := strings.Join([]string{r.options.DiscoveryPrefix, entity.component, node, object, "config"}, "/")
+		token := r.client.Publish(topic, r.options.QoS, true, data)
+		go func() {
+			if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+				log.Printf("Could not publish discovery config to %s: %s", topic, token.Error())
+			}
+		}()
+	}
+}
@@ -0,0 +1,381 @@
+package monitor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+// Lines to keep waiting when InfluxDB can't be reached, the oldest are dropped first
+const maxInfluxBacklog = 10000
+
+// Keep UDP packets under the usual MTU so they don't get fragmented
+const maxInfluxPacket = 1400
+
+type InfluxOptions struct {
+	// http(s)://host:8086 to use /api/v2/write, or udp://host:8089
+	URL    string
+	Org    string
+	Bucket string
+	Token  string
+	// Minutes are written to Measurement, pulses to Measurement_pulses
+	Measurement string
+	// Added to every line, the device tag is added with several inputs
+	Tags map[string]string
+	// Write once this many lines are waiting, or every FlushInterval
+	BatchSize     int
+	FlushInterval time.Duration
+	// Also write the speed of every pulse
+	Pulses bool
+}
+
+// Parse tags from e.g. "host=pi,room=office"
+func ParseInfluxTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+
+	return tags, nil
+}
+
+// Writes data points, and optionally pulses, to InfluxDB in line protocol
+type InfluxReporter struct {
+	options InfluxOptions
+	target  *url.URL
+	lines   []string
+	// How many of the oldest lines have been dropped, so a flush knows how much of its
+	// batch is still in lines
+	dropped int
+	// Error of the latest write, nil when it worked
+	lastError  error
+	linesMutex *sync.Mutex
+	flushMutex *sync.Mutex
+	client     http.Client
+	// Wakes up the flusher when a batch is full
+	wake        chan struct{}
+	stopping    chan bool
+	stopped     chan bool
+	lastFailure time.Time
+}
+
+func NewInfluxReporter(options InfluxOptions) (*InfluxReporter, error) {
+	target, err := url.Parse(options.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.Scheme != "http" && target.Scheme != "https" && target.Scheme != "udp" {
+		return nil, fmt.Errorf("unsupported scheme %q, expected http, https or udp", target.Scheme)
+	}
+
+	if target.Scheme != "udp" && options.Bucket == "" {
+		return nil, fmt.Errorf("a bucket is needed for writing over HTTP")
+	}
+
+	r := &InfluxReporter{}
+	r.options = options
+	r.target = target
+	r.lines = []string{}
+	r.linesMutex = &sync.Mutex{}
+	r.flushMutex = &sync.Mutex{}
+	r.client = http.Client{Timeout: 10 * time.Second}
+	r.wake = make(chan struct{}, 1)
+	r.stopping = make(chan bool)
+	r.stopped = make(chan bool)
+
+	return r, nil
+}
+
+func (r *InfluxReporter) Start() {
+	go func() {
+		defer close(r.stopped)
+
+		tick := time.NewTicker(r.options.FlushInterval)
+		defer tick.Stop()
+
+		for {
+			select {
+			case <-tick.C:
+				r.flush()
+			case <-r.wake:
+				r.flush()
+			case <-r.stopping:
+				return
+			}
+		}
+	}()
+}
+
+// Write whatever is still waiting
+func (r *InfluxReporter) Close() {
+	close(r.stopping)
+	<-r.stopped
+	r.flush()
+}
+
+func (r *InfluxReporter) addPulse(device string, record GPIORecord) {
+	if !r.options.Pulses {
+		return
+	}
+
+	r.add(r.line(r.options.Measurement+"_pulses", device, []influxField{
+		{"meters", record.Meters, 64},
+		{"mps", record.MetersPerSecond, 64},
+		{"kph", record.KilometersPerHour, 64},
+	}, record.Time))
+}
+
+func (r *InfluxReporter) Name() string {
+	return "influxdb " + r.options.URL
+}
+
+func (r *InfluxReporter) Waiting() int {
+	r.linesMutex.Lock()
+	defer r.linesMutex.Unlock()
+
+	return len(r.lines)
+}
+
+// Queues the data points to be written with the next batch, the error is from the
+// previous write if it failed
+func (r *InfluxReporter) Report(device string, report StatsReport) error {
+	for _, fdp := range report.DataPoints {
+		ts, err := time.ParseInLocation(godometer.APITimeLayout, fdp.Timestamp, utc)
+		if err != nil {
+			log.Printf("Not writing data point with invalid timestamp %s to InfluxDB", fdp.Timestamp)
+			continue
+		}
+
+		// Updated data points have the same timestamp and replace the earlier ones
+		r.add(r.line(r.options.Measurement, device, []influxField{
+			{"meters", float64(fdp.Meters), 32},
+			{"mps", float64(fdp.MetersPerSecond), 32},
+			{"kph", float64(fdp.KilometersPerHour), 32},
+			{"total_meters", fdp.TotalMeters, 64},
+			{"moving_seconds", float64(fdp.MovingSeconds), 32},
+			{"idle_seconds", float64(fdp.IdleSeconds), 32},
+		}, ts))
+	}
+
+	r.linesMutex.Lock()
+	defer r.linesMutex.Unlock()
+
+	return r.lastError
+}
+
+func (r *InfluxReporter) add(line string) {
+	r.linesMutex.Lock()
+	r.lines = append(r.lines, line)
+	if len(r.lines) > maxInfluxBacklog {
+		r.dropped += len(r.lines) - maxInfluxBacklog
+		r.lines = r.lines[len(r.lines)-maxInfluxBacklog:]
+	}
+	full := len(r.lines) >= r.options.BatchSize
+	r.linesMutex.Unlock()
+
+	if full {
+		// The flusher is already awake if this doesn't fit
+		select {
+		case r.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Send the waiting lines in batches, lines that could not be sent are tried again later
+func (r *InfluxReporter) flush() {
+	r.flushMutex.Lock()
+	defer r.flushMutex.Unlock()
+
+	for {
+		r.linesMutex.Lock()
+		batch := append([]string{}, r.lines[:minInt(len(r.lines), r.options.BatchSize)]...)
+		dropped := r.dropped
+		r.linesMutex.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		var err error
+		if r.target.Scheme == "udp" {
+			err = r.writeUDP(batch)
+		} else {
+			err = r.writeHTTP(batch)
+		}
+
+		if err != nil {
+			// Don't fill the log while InfluxDB is down
+			if time.Since(r.lastFailure) > time.Minute {
+				log.Printf("Could not write to InfluxDB at %s: %s", r.options.URL, err)
+			}
+			r.lastFailure = time.Now()
+
+			r.linesMutex.Lock()
+			r.lastError = err
+			r.linesMutex.Unlock()
+			return
+		}
+
+		// Lines dropped while sending were from the start of the batch
+		r.linesMutex.Lock()
+		r.lastError = nil
+		sent := len(batch) - (r.dropped - dropped)
+		if sent > 0 {
+			r.lines = r.lines[minInt(len(r.lines), sent):]
+		}
+		r.linesMutex.Unlock()
+	}
+}
+
+func (r *InfluxReporter) writeHTTP(batch []string) error {
+	query := url.Values{}
+	query.Set("org", r.options.Org)
+	query.Set("bucket", r.options.Bucket)
+	query.Set("precision", "ns")
+
+	target := *r.target
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/api/v2/write"
+	target.RawQuery = query.Encode()
+
+	body := strings.Join(batch, "\n") + "\n"
+	request, err := http.NewRequest("POST", target.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if r.options.Token != "" {
+		request.Header.Set("Authorization", "Token "+r.options.Token)
+	}
+
+	resp, err := r.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// UDP has no acknowledgements, so this only fails when the packets can't be sent at all
+func (r *InfluxReporter) writeUDP(batch []string) error {
+	conn, err := net.Dial("udp", r.target.Host)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	var packet bytes.Buffer
+	for _, line := range batch {
+		if packet.Len() > 0 && packet.Len()+len(line)+1 > maxInfluxPacket {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+
+		packet.WriteString(line)
+		packet.WriteString("\n")
+	}
+
+	_, err = conn.Write(packet.Bytes())
+	return err
+}
+
+type influxField struct {
+	key   string
+	value float64
+	// 32 for float32 values, so they're written without the noise of the conversion
+	bits int
+}
+
+// e.g. godometer,device=left,host=pi meters=51.1,mps=1.1 1602972000000000000
+func (r *InfluxReporter) line(measurement string, device string, fields []influxField, t time.Time) string {
+	tags := map[string]string{}
+	for k, v := range r.options.Tags {
+		tags[k] = v
+	}
+	if device != "" {
+		tags["device"] = device
+	}
+
+	// Sorted tags are faster for InfluxDB to handle
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(escapeInflux(measurement, ", "))
+	for _, k := range keys {
+		sb.WriteString(",")
+		sb.WriteString(escapeInflux(k, ", ="))
+		sb.WriteString("=")
+		sb.WriteString(escapeInflux(tags[k], ", ="))
+	}
+
+	separator := " "
+	for _, f := range fields {
+		// Not valid in line protocol
+		if math.IsNaN(f.value) || math.IsInf(f.value, 0) {
+			continue
+		}
+
+		sb.WriteString(separator)
+		separator = ","
+		sb.WriteString(escapeInflux(f.key, ", ="))
+		sb.WriteString("=")
+		sb.WriteString(strconv.FormatFloat(f.value, 'f', -1, f.bits))
+	}
+
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatInt(t.UnixNano(), 10))
+
+	return sb.String()
+}
+
+// Backslash escape the special characters of a part of a line
+func escapeInflux(s string, special string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(special, c) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
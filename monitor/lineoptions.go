@@ -0,0 +1,71 @@
+package monitor
+
+import (
+	"fmt"
+	"time"
+)
+
+type Bias int
+
+const (
+	BiasAsIs Bias = iota
+	BiasPullUp
+	BiasPullDown
+	BiasDisabled
+)
+
+func (b Bias) String() string {
+	switch b {
+	case BiasPullUp:
+		return "pull-up"
+	case BiasPullDown:
+		return "pull-down"
+	case BiasDisabled:
+		return "disabled"
+	}
+	return "as-is"
+}
+
+func ParseBias(s string) (Bias, error) {
+	switch s {
+	case "", "as-is":
+		return BiasAsIs, nil
+	case "pull-up":
+		return BiasPullUp, nil
+	case "pull-down":
+		return BiasPullDown, nil
+	case "disabled":
+		return BiasDisabled, nil
+	}
+	return BiasAsIs, fmt.Errorf("unknown bias %q, expected as-is, pull-up, pull-down or disabled", s)
+}
+
+func ParseEdge(s string) (Edge, error) {
+	switch s {
+	case "rising":
+		return RisingEdge, nil
+	case "falling":
+		return FallingEdge, nil
+	}
+	return RisingEdge, fmt.Errorf("unknown edge %q, expected rising or falling", s)
+}
+
+// How the GPIO lines should be configured, different sensor modules need different settings
+type GPIOLineOptions struct {
+	Bias      Bias
+	ActiveLow bool
+	// Which edge of a pulse counts as the wheel turning, Wheel always counts the rising one
+	// so for falling the primary line edges are swapped before passing them on
+	CountEdge Edge
+	// Debouncing done by the kernel, requires Linux v5.10 or later. Zero to disable.
+	Debounce time.Duration
+}
+
+func DefaultGPIOLineOptions() GPIOLineOptions {
+	return GPIOLineOptions{
+		Bias:      BiasAsIs,
+		ActiveLow: false,
+		CountEdge: RisingEdge,
+		Debounce:  0,
+	}
+}
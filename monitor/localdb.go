@@ -0,0 +1,233 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Rewrite the local DB once it has this many records, about a day of minutes
+const compactAfterRecords = 1440
+
+// Append-only log of data points, each line is a CRC32 of the JSON and the JSON itself,
+// e.g. "1a2b3c4d {...}". Updated data points are appended again and the last one wins.
+// A power cut can only tear the last line, and damaged lines are skipped when reading.
+type LocalDB struct {
+	path    string
+	records int
+}
+
+func NewLocalDB(path string) *LocalDB {
+	db := &LocalDB{}
+	db.path = path
+
+	return db
+}
+
+// Read the latest version of every data point, oldest first
+func (db *LocalDB) Read() ([]FileDataPoint, error) {
+	file, err := os.Open(db.path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Error closing %s: %s", db.path, err)
+		}
+	}()
+
+	dataPoints, records, err := readRecords(file, db.path)
+	db.records = records
+	return dataPoints, err
+}
+
+// Add new and updated data points to the end of the file
+func (db *LocalDB) Append(rows []FileDataPoint) error {
+	contents, err := formatRecords(rows)
+	if err != nil {
+		return err
+	}
+
+	if err := appendFileSync(db.path, contents); err != nil {
+		return err
+	}
+
+	db.records += len(rows)
+	return nil
+}
+
+// Replace the file with only the given data points
+func (db *LocalDB) Compact(rows []FileDataPoint) error {
+	contents, err := formatRecords(rows)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(db.path, contents); err != nil {
+		return err
+	}
+
+	db.records = len(rows)
+	return nil
+}
+
+func (db *LocalDB) NeedsCompaction() bool {
+	return db.records > compactAfterRecords
+}
+
+// Read the latest version of every data point from a stream of records, name is for logging
+func readRecords(r io.Reader, name string) ([]FileDataPoint, int, error) {
+	dataPoints := []FileDataPoint{}
+	positions := map[string]int{}
+	records := 0
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		lineno += 1
+
+		fdp, err := parseRecord(scanner.Bytes())
+		if err != nil {
+			log.Printf("Skipping damaged record on %s line %d: %s", name, lineno, err)
+			continue
+		}
+
+		records += 1
+		if i, ok := positions[fdp.Timestamp]; ok {
+			dataPoints[i] = fdp
+			continue
+		}
+
+		positions[fdp.Timestamp] = len(dataPoints)
+		dataPoints = append(dataPoints, fdp)
+	}
+
+	return dataPoints, records, scanner.Err()
+}
+
+// Records for rows, one per line
+func formatRecords(rows []FileDataPoint) ([]byte, error) {
+	var contents bytes.Buffer
+	for _, row := range rows {
+		line, err := formatRecord(row)
+		if err != nil {
+			return nil, err
+		}
+		contents.Write(line)
+	}
+
+	return contents.Bytes(), nil
+}
+
+func formatRecord(fdp FileDataPoint) ([]byte, error) {
+	data, err := json.Marshal(fdp)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)), nil
+}
+
+func parseRecord(line []byte) (FileDataPoint, error) {
+	fdp := FileDataPoint{}
+	data := line
+
+	// Files from older versions have plain JSON without a checksum
+	if len(line) == 0 || line[0] != '{' {
+		if len(line) < 10 || line[8] != ' ' {
+			return fdp, fmt.Errorf("no checksum")
+		}
+
+		checksum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+		if err != nil {
+			return fdp, fmt.Errorf("invalid checksum")
+		}
+
+		data = line[9:]
+		if crc32.ChecksumIEEE(data) != uint32(checksum) {
+			return fdp, fmt.Errorf("checksum mismatch")
+		}
+	}
+
+	err := json.Unmarshal(data, &fdp)
+	return fdp, err
+}
+
+// Append to the end of path and wait until it's on the disk
+func appendFileSync(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Start on a new line if the last write was torn, so only that record is lost
+	if info, err := file.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			data = append([]byte("\n"), data...)
+		}
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Write to a temporary file and rename it over path, so a power cut leaves either the
+// old or the new contents and never a truncated file
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// Make the rename itself durable, not every system supports this so errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+
+	_ = d.Sync()
+	_ = d.Close()
+}
@@ -0,0 +1,246 @@
+package monitor
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Longest wait between attempts to connect to the broker
+const maxMQTTReconnectInterval = time.Minute
+
+type MQTTOptions struct {
+	// e.g. tcp://localhost:1883
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	// Topics are e.g. godometer/speed, or godometer/left/speed with several inputs. Only
+	// the prefix is configurable, the names after it are fixed.
+	TopicPrefix string
+	QoS         byte
+	Retain      bool
+	// Publish the live speed at most this often
+	LiveInterval time.Duration
+	// Publish Home Assistant discovery configs under DiscoveryPrefix
+	Discovery       bool
+	DiscoveryPrefix string
+}
+
+type MQTTSpeed struct {
+	Timestamp         string  `json:"ts"`
+	Moving            bool    `json:"moving"`
+	MetersPerSecond   float64 `json:"mps"`
+	KilometersPerHour float64 `json:"kph"`
+}
+
+type MQTTOdometer struct {
+	Timestamp   string  `json:"ts"`
+	TotalMeters float64 `json:"tm"`
+}
+
+// Distance on the local day Date
+type MQTTToday struct {
+	Date   string  `json:"date"`
+	Meters float64 `json:"m"`
+}
+
+// When the stats were last reported somewhere besides MQTT
+type MQTTReport struct {
+	Timestamp string `json:"ts"`
+}
+
+// Publishes the live speed, every minute's data point, the odometer, today's distance and
+// the last report to an MQTT broker. The monitor availability is in <prefix>/status as
+// online or offline.
+type MQTTReporter struct {
+	options      MQTTOptions
+	client       mqtt.Client
+	devices      []string
+	devicesMutex *sync.Mutex
+	lastLive     map[string]time.Time
+	lastMoving   map[string]bool
+	liveMutex    *sync.Mutex
+	stopping     chan bool
+	connecting   *sync.WaitGroup
+}
+
+func NewMQTTReporter(options MQTTOptions) *MQTTReporter {
+	r := &MQTTReporter{}
+	r.options = options
+	r.devices = []string{}
+	r.devicesMutex = &sync.Mutex{}
+	r.lastLive = map[string]time.Time{}
+	r.lastMoving = map[string]bool{}
+	r.liveMutex = &sync.Mutex{}
+	r.stopping = make(chan bool)
+	r.connecting = &sync.WaitGroup{}
+
+	opts := mqtt.NewClientOptions()
+	opts.AddBroker(options.Broker)
+	opts.SetClientID(options.ClientID)
+	opts.SetUsername(options.Username)
+	opts.SetPassword(options.Password)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(maxMQTTReconnectInterval)
+	opts.SetWill(r.topic("", "status"), "offline", options.QoS, true)
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Printf("Connected to MQTT broker %s", options.Broker)
+		c.Publish(r.topic("", "status"), options.QoS, true, "online")
+		if options.Discovery {
+			for _, device := range r.knownDevices() {
+				r.publishDiscovery(device)
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Printf("Lost connection to MQTT broker %s: %s", options.Broker, err)
+	})
+
+	r.client = mqtt.NewClient(opts)
+
+	return r
+}
+
+// Connect in the background, retrying until the broker is reachable. After the first
+// connection the client reconnects by itself.
+func (r *MQTTReporter) Start() {
+	r.connecting.Add(1)
+	go func() {
+		defer r.connecting.Done()
+
+		delay := time.Second
+		for {
+			token := r.client.Connect()
+			token.Wait()
+			if token.Error() == nil {
+				return
+			}
+
+			log.Printf("Could not connect to MQTT broker %s: %s. Trying again in %s.", r.options.Broker, token.Error(), delay)
+			select {
+			case <-time.After(delay):
+			case <-r.stopping:
+				return
+			}
+
+			delay *= 2
+			if delay > maxMQTTReconnectInterval {
+				delay = maxMQTTReconnectInterval
+			}
+		}
+	}()
+}
+
+func (r *MQTTReporter) Close() {
+	close(r.stopping)
+	r.connecting.Wait()
+
+	if r.client.IsConnected() {
+		token := r.client.Publish(r.topic("", "status"), r.options.QoS, true, "offline")
+		token.WaitTimeout(time.Second)
+		r.client.Disconnect(250)
+	}
+}
+
+// Another input to publish stats of
+func (r *MQTTReporter) addDevice(device string) {
+	r.devicesMutex.Lock()
+	r.devices = append(r.devices, device)
+	r.devicesMutex.Unlock()
+
+	if r.options.Discovery {
+		r.publishDiscovery(device)
+	}
+}
+
+func (r *MQTTReporter) knownDevices() []string {
+	r.devicesMutex.Lock()
+	defer r.devicesMutex.Unlock()
+
+	return append([]string{}, r.devices...)
+}
+
+// Rate limited, except for when starting to move or stopping
+func (r *MQTTReporter) publishSpeed(device string, now time.Time, moving bool, mps float64, kph float64) {
+	r.liveMutex.Lock()
+	if moving == r.lastMoving[device] && now.Sub(r.lastLive[device]) < r.options.LiveInterval {
+		r.liveMutex.Unlock()
+		return
+	}
+	r.lastLive[device] = now
+	r.lastMoving[device] = moving
+	r.liveMutex.Unlock()
+
+	r.publish(r.topic(device, "speed"), MQTTSpeed{
+		Timestamp:         now.In(utc).Format(time.RFC3339),
+		Moving:            moving,
+		MetersPerSecond:   mps,
+		KilometersPerHour: kph,
+	})
+}
+
+func (r *MQTTReporter) Name() string {
+	return "mqtt " + r.options.Broker
+}
+
+// Publishes the minutes, the odometer and today's distance. Nothing is kept while
+// disconnected, the next report has the latest totals anyway.
+func (r *MQTTReporter) Report(device string, report StatsReport) error {
+	if !r.client.IsConnected() {
+		return fmt.Errorf("not connected")
+	}
+
+	for _, fdp := range report.DataPoints {
+		r.publish(r.topic(device, "minute"), fdp)
+	}
+
+	r.publish(r.topic(device, "odometer"), MQTTOdometer{
+		Timestamp:   report.Time.In(utc).Format(time.RFC3339),
+		TotalMeters: report.TotalMeters,
+	})
+
+	r.publish(r.topic(device, "today"), MQTTToday{
+		Date:   report.Today,
+		Meters: report.TodayMeters,
+	})
+
+	return nil
+}
+
+func (r *MQTTReporter) publishReport(device string, t time.Time) {
+	r.publish(r.topic(device, "report"), MQTTReport{
+		Timestamp: t.In(utc).Format(time.RFC3339),
+	})
+}
+
+func (r *MQTTReporter) topic(device string, name string) string {
+	if device != "" {
+		return r.options.TopicPrefix + "/" + device + "/" + name
+	}
+	return r.options.TopicPrefix + "/" + name
+}
+
+// MQTT is only for live data, anything published while disconnected is dropped
+func (r *MQTTReporter) publish(topic string, payload interface{}) {
+	if !r.client.IsConnected() {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Could not marshal MQTT message for %s: %s. This should not happen.", topic, err)
+		return
+	}
+
+	token := r.client.Publish(topic, r.options.QoS, r.options.Retain, data)
+	go func() {
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			log.Printf("Could not publish to %s: %s", topic, token.Error())
+		}
+	}()
+}
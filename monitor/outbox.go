@@ -0,0 +1,393 @@
+package monitor
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+)
+
+// Most of each kind to send in one request, keeps requests reasonable after being offline for long.
+// The server keeps what each device sent for every minute, so a batch sent again is only counted
+// once, and a minute sent again with new values replaces the earlier ones.
+const (
+	maxBatchDataPoints = 60
+	maxBatchSessions   = 20
+	maxBatchSamples    = 360
+)
+
+// Lines in the outbox file before it's compacted, as long as most of them are no longer needed
+const minOutboxCompactLines = 1000
+
+// One line in the outbox file, only one of the things is set. Things replace queued ones with
+// the same key, or with Ack remove them if they haven't changed since.
+type outboxEntry struct {
+	Ack       bool           `json:"ack,omitempty"`
+	DataPoint *FileDataPoint `json:"dp,omitempty"`
+	Session   *FileSession   `json:"session,omitempty"`
+	Sample    *FileSample    `json:"sample,omitempty"`
+}
+
+// Part of the outbox to send in one request
+type OutboxBatch struct {
+	DataPoints []FileDataPoint
+	Sessions   []FileSession
+	Samples    []FileSample
+}
+
+func (ob OutboxBatch) Empty() bool {
+	return len(ob.DataPoints) == 0 && len(ob.Sessions) == 0 && len(ob.Samples) == 0
+}
+
+// Everything waiting to be delivered to a destination. It's stored next to the local DB as
+// a log of the changes, and things only leave it once the destination has acknowledged them.
+type Outbox struct {
+	path       string
+	dataPoints []FileDataPoint
+	sessions   []FileSession
+	samples    []FileSample
+	// Lines in the file, to know when to compact it
+	lines       int
+	sending     bool
+	outboxMutex *sync.Mutex
+}
+
+func NewOutbox(path string) *Outbox {
+	o := &Outbox{}
+	o.path = path
+	o.dataPoints = []FileDataPoint{}
+	o.sessions = []FileSession{}
+	o.samples = []FileSample{}
+	o.outboxMutex = &sync.Mutex{}
+	o.read()
+
+	return o
+}
+
+// Queue things to be delivered. Data points replace any queued ones with the same timestamp
+// as they have been updated, samples for the same time are from pulses that came late.
+func (o *Outbox) Add(dataPoints []FileDataPoint, sessions []FileSession, samples []FileSample) {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	var entries []outboxEntry
+	for i := range dataPoints {
+		if o.setDataPoint(dataPoints[i]) {
+			entries = append(entries, outboxEntry{DataPoint: &dataPoints[i]})
+		}
+	}
+
+	for i := range sessions {
+		if o.setSession(sessions[i]) {
+			entries = append(entries, outboxEntry{Session: &sessions[i]})
+		}
+	}
+
+	for _, fs := range samples {
+		for _, queued := range o.samples {
+			if queued.Timestamp == fs.Timestamp {
+				queued.Meters += fs.Meters
+				queued.MetersPerSecond = (queued.MetersPerSecond + fs.MetersPerSecond) / 2
+				queued.KilometersPerHour = (queued.KilometersPerHour + fs.KilometersPerHour) / 2
+				fs = queued
+			}
+		}
+
+		if o.setSample(fs) {
+			sample := fs
+			entries = append(entries, outboxEntry{Sample: &sample})
+		}
+	}
+
+	o.write(entries)
+}
+
+// Replace a queued data point with the same timestamp, returns false if there's no change
+func (o *Outbox) setDataPoint(fdp FileDataPoint) bool {
+	for i, queued := range o.dataPoints {
+		if queued.Timestamp == fdp.Timestamp {
+			if queued == fdp {
+				return false
+			}
+			o.dataPoints[i] = fdp
+			return true
+		}
+	}
+
+	o.dataPoints = append(o.dataPoints, fdp)
+	return true
+}
+
+func (o *Outbox) setSession(fs FileSession) bool {
+	for i, queued := range o.sessions {
+		if queued.Start == fs.Start {
+			if queued == fs {
+				return false
+			}
+			o.sessions[i] = fs
+			return true
+		}
+	}
+
+	o.sessions = append(o.sessions, fs)
+	return true
+}
+
+func (o *Outbox) setSample(fs FileSample) bool {
+	for i, queued := range o.samples {
+		if queued.Timestamp == fs.Timestamp {
+			if queued == fs {
+				return false
+			}
+			o.samples[i] = fs
+			return true
+		}
+	}
+
+	o.samples = append(o.samples, fs)
+	return true
+}
+
+// Start sending, returns false if already being sent elsewhere
+func (o *Outbox) StartSending() bool {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	if o.sending {
+		return false
+	}
+	o.sending = true
+	return true
+}
+
+func (o *Outbox) StopSending() {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	o.sending = false
+}
+
+// The oldest things waiting to be delivered
+func (o *Outbox) Batch() OutboxBatch {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	batch := OutboxBatch{
+		DataPoints: make([]FileDataPoint, minInt(len(o.dataPoints), maxBatchDataPoints)),
+		Sessions:   make([]FileSession, minInt(len(o.sessions), maxBatchSessions)),
+		Samples:    make([]FileSample, minInt(len(o.samples), maxBatchSamples)),
+	}
+
+	copy(batch.DataPoints, o.dataPoints)
+	copy(batch.Sessions, o.sessions)
+	copy(batch.Samples, o.samples)
+
+	return batch
+}
+
+// Remove a delivered batch. Anything updated while it was being sent stays to be sent again.
+func (o *Outbox) Acknowledge(batch OutboxBatch) {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	var entries []outboxEntry
+	for i := range batch.DataPoints {
+		if o.removeDataPoint(batch.DataPoints[i]) {
+			entries = append(entries, outboxEntry{Ack: true, DataPoint: &batch.DataPoints[i]})
+		}
+	}
+
+	for i := range batch.Sessions {
+		if o.removeSession(batch.Sessions[i]) {
+			entries = append(entries, outboxEntry{Ack: true, Session: &batch.Sessions[i]})
+		}
+	}
+
+	for i := range batch.Samples {
+		if o.removeSample(batch.Samples[i]) {
+			entries = append(entries, outboxEntry{Ack: true, Sample: &batch.Samples[i]})
+		}
+	}
+
+	o.write(entries)
+}
+
+// Remove a data point if it's still queued as it is, returns false otherwise
+func (o *Outbox) removeDataPoint(fdp FileDataPoint) bool {
+	for i, queued := range o.dataPoints {
+		if queued == fdp {
+			o.dataPoints = append(o.dataPoints[:i:i], o.dataPoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outbox) removeSession(fs FileSession) bool {
+	for i, queued := range o.sessions {
+		if queued == fs {
+			o.sessions = append(o.sessions[:i:i], o.sessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outbox) removeSample(fs FileSample) bool {
+	for i, queued := range o.samples {
+		if queued == fs {
+			o.samples = append(o.samples[:i:i], o.samples[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (o *Outbox) Len() int {
+	o.outboxMutex.Lock()
+	defer o.outboxMutex.Unlock()
+
+	return o.len()
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (o *Outbox) read() {
+	file, err := os.Open(o.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+
+		log.Printf("Uh oh, could not read %s: %s", o.path, err)
+		return
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Error closing %s: %s", o.path, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno += 1
+
+		entry := outboxEntry{}
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			log.Printf("Error reading %s line %d: %s", o.path, lineno, err)
+			continue
+		}
+
+		if entry.Ack {
+			if entry.DataPoint != nil {
+				o.removeDataPoint(*entry.DataPoint)
+			} else if entry.Session != nil {
+				o.removeSession(*entry.Session)
+			} else if entry.Sample != nil {
+				o.removeSample(*entry.Sample)
+			}
+		} else if entry.DataPoint != nil {
+			o.setDataPoint(*entry.DataPoint)
+		} else if entry.Session != nil {
+			o.setSession(*entry.Session)
+		} else if entry.Sample != nil {
+			o.setSample(*entry.Sample)
+		}
+	}
+	o.lines = lineno
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error parsing outbox from %s: %s", o.path, err)
+	}
+
+	if o.len() > 0 {
+		log.Printf("Read %d undelivered data points, %d sessions and %d samples from %s", len(o.dataPoints), len(o.sessions), len(o.samples), o.path)
+	}
+}
+
+func (o *Outbox) len() int {
+	return len(o.dataPoints) + len(o.sessions) + len(o.samples)
+}
+
+// Append the changes to the file, nothing is written when nothing changed
+func (o *Outbox) write(entries []outboxEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	if o.lines+len(entries) > minOutboxCompactLines && o.lines+len(entries) > 2*o.len() {
+		o.compact()
+		return
+	}
+
+	data, err := marshalOutboxEntries(entries)
+	if err != nil {
+		log.Printf("Could not marshal outbox entry: %s. This should not happen.", err)
+		return
+	}
+
+	err = appendFileSync(o.path, data)
+	if err != nil {
+		// Everything is still in memory, the whole outbox is written the next time
+		log.Printf("Could not write to %s: %s", o.path, err)
+		o.lines = minOutboxCompactLines + 2*o.len()
+		return
+	}
+
+	o.lines += len(entries)
+}
+
+// Replace the file with only what's still queued
+func (o *Outbox) compact() {
+	var entries []outboxEntry
+	for i := range o.dataPoints {
+		entries = append(entries, outboxEntry{DataPoint: &o.dataPoints[i]})
+	}
+	for i := range o.sessions {
+		entries = append(entries, outboxEntry{Session: &o.sessions[i]})
+	}
+	for i := range o.samples {
+		entries = append(entries, outboxEntry{Sample: &o.samples[i]})
+	}
+
+	data, err := marshalOutboxEntries(entries)
+	if err != nil {
+		log.Printf("Could not marshal outbox entry: %s. This should not happen.", err)
+		return
+	}
+
+	err = writeFileAtomic(o.path, data)
+	if err != nil {
+		// Everything is still in memory, maybe the next write works
+		log.Printf("Could not write to %s: %s", o.path, err)
+		return
+	}
+
+	o.lines = len(entries)
+}
+
+func marshalOutboxEntries(entries []outboxEntry) ([]byte, error) {
+	var contents bytes.Buffer
+	for _, entry := range entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		contents.Write(data)
+		contents.WriteString("\n")
+	}
+
+	return contents.Bytes(), nil
+}
@@ -0,0 +1,48 @@
+package monitor
+
+import (
+	"context"
+	"time"
+)
+
+type Edge int
+
+const (
+	RisingEdge Edge = iota
+	FallingEdge
+)
+
+func (e Edge) String() string {
+	if e == RisingEdge {
+		return "rising"
+	}
+	return "falling"
+}
+
+// Which sensor a pulse came from. The direction channel is an optional second
+// sensor offset from the primary one for quadrature direction detection.
+const (
+	PrimaryChannel   = 0
+	DirectionChannel = 1
+)
+
+// A single raw edge event from a sensor
+type Pulse struct {
+	Time    time.Time
+	Edge    Edge
+	Channel int
+}
+
+type PulseHandler func(Pulse)
+
+// Anything that can produce wheel pulses, e.g. a GPIO line or a simulation
+type PulseSource interface {
+	// Feed pulses to handler until ctx is done or the source runs out of pulses. Returns
+	// an error if the source can't be used at all.
+	Monitor(ctx context.Context, handler PulseHandler) error
+}
+
+// Anything keeping count of what it has done, e.g. dropped records, for the status
+type CounterSource interface {
+	Counters() map[string]uint64
+}
@@ -0,0 +1,227 @@
+package monitor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pulse logs are plain text, one event per line after a header:
+//
+//	# godometer pulse log v1 start=2020-08-20T12:00:00.123456789Z
+//	0 r too-slow
+//	41250 f ok
+//	2010 r direction 1
+//
+// The first column is microseconds since the previous event, then the edge
+// (r for rising, f for falling) and what the wheel decided to do with it. Pulses
+// from other than the primary channel have the channel number at the end.
+const pulseLogHeader = "# godometer pulse log v1 start="
+
+type PulseLogWriter struct {
+	path     string
+	file     *os.File
+	writer   *bufio.Writer
+	previous time.Time
+	mutex    *sync.Mutex
+}
+
+func NewPulseLogWriter(path string) (*PulseLogWriter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	plw := &PulseLogWriter{}
+	plw.path = path
+	plw.file = file
+	plw.writer = bufio.NewWriter(file)
+	plw.mutex = &sync.Mutex{}
+
+	return plw, nil
+}
+
+func edgeCode(e Edge) string {
+	if e == RisingEdge {
+		return "r"
+	}
+	return "f"
+}
+
+// Record is a PulseObserver, add it to a Wheel to log everything it sees
+func (plw *PulseLogWriter) Record(p Pulse, status PulseStatus) {
+	plw.mutex.Lock()
+	defer plw.mutex.Unlock()
+
+	if plw.previous.IsZero() {
+		plw.previous = p.Time
+		_, err := fmt.Fprintf(plw.writer, "%s%s\n", pulseLogHeader, p.Time.UTC().Format(time.RFC3339Nano))
+		if err != nil {
+			log.Printf("Could not write to pulse log %s: %s", plw.path, err)
+			return
+		}
+	}
+
+	delta := p.Time.Sub(plw.previous) / time.Microsecond
+	plw.previous = p.Time
+
+	var err error
+	if p.Channel == PrimaryChannel {
+		_, err = fmt.Fprintf(plw.writer, "%d %s %s\n", delta, edgeCode(p.Edge), status)
+	} else {
+		_, err = fmt.Fprintf(plw.writer, "%d %s %s %d\n", delta, edgeCode(p.Edge), status, p.Channel)
+	}
+	if err == nil {
+		err = plw.writer.Flush()
+	}
+
+	if err != nil {
+		log.Printf("Could not write to pulse log %s: %s", plw.path, err)
+	}
+}
+
+func (plw *PulseLogWriter) Close() error {
+	plw.mutex.Lock()
+	defer plw.mutex.Unlock()
+
+	err := plw.writer.Flush()
+	if err != nil {
+		_ = plw.file.Close()
+		return err
+	}
+
+	return plw.file.Close()
+}
+
+// Recorded events from a pulse log
+type LoggedPulse struct {
+	Pulse
+	Status PulseStatus
+}
+
+func ReadPulseLog(path string) ([]LoggedPulse, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Error closing %s: %s", path, err)
+		}
+	}()
+
+	var pulses []LoggedPulse
+	var current time.Time
+
+	scanner := bufio.NewScanner(file)
+	lineno := 0
+	for scanner.Scan() {
+		lineno += 1
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, pulseLogHeader) {
+			current, err = time.Parse(time.RFC3339Nano, strings.TrimPrefix(line, pulseLogHeader))
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid start time: %s", path, lineno, err)
+			}
+			continue
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current.IsZero() {
+			return nil, fmt.Errorf("%s line %d: missing pulse log header", path, lineno)
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 3 && len(fields) != 4 {
+			return nil, fmt.Errorf("%s line %d: expected 3 or 4 fields, got %d", path, lineno, len(fields))
+		}
+
+		delta, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s line %d: invalid delta: %s", path, lineno, err)
+		}
+
+		edge := FallingEdge
+		if fields[1] == "r" {
+			edge = RisingEdge
+		} else if fields[1] != "f" {
+			return nil, fmt.Errorf("%s line %d: invalid edge %q", path, lineno, fields[1])
+		}
+
+		channel := PrimaryChannel
+		if len(fields) == 4 {
+			channel, err = strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid channel: %s", path, lineno, err)
+			}
+		}
+
+		current = current.Add(time.Duration(delta) * time.Microsecond)
+		pulses = append(pulses, LoggedPulse{
+			Pulse:  Pulse{Time: current, Edge: edge, Channel: channel},
+			Status: PulseStatus(fields[2]),
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+
+	return pulses, nil
+}
+
+// Feeds a recorded pulse log back as if it was happening live. The pulses
+// keep their original timestamps so the results are the same on every replay.
+// Monitor returns once all pulses have been replayed.
+type ReplaySource struct {
+	path  string
+	speed float64
+}
+
+// Speed of 1 replays in real time, 10 in ten times real time etc.
+func NewReplaySource(path string, speed float64) *ReplaySource {
+	rs := &ReplaySource{}
+	rs.path = path
+	rs.speed = speed
+
+	return rs
+}
+
+func (rs *ReplaySource) Monitor(ctx context.Context, handler PulseHandler) error {
+	pulses, err := ReadPulseLog(rs.path)
+	if err != nil {
+		return fmt.Errorf("could not read pulse log: %s", err)
+	}
+
+	log.Printf("Replaying %d pulses from %s at %.1fx speed", len(pulses), rs.path, rs.speed)
+
+	var previous time.Time
+	for _, lp := range pulses {
+		if !previous.IsZero() {
+			wait := time.Duration(float64(lp.Time.Sub(previous)) / rs.speed)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		previous = lp.Time
+
+		handler(lp.Pulse)
+	}
+
+	log.Printf("Finished replaying %s", rs.path)
+	return nil
+}
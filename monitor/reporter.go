@@ -0,0 +1,221 @@
+package monitor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// What was saved in one go: the new and updated data points, and the sessions and
+// samples finished since the previous time, with the totals at that time
+type StatsReport struct {
+	DataPoints  []FileDataPoint
+	Sessions    []FileSession
+	Samples     []FileSample
+	Time        time.Time
+	TotalMeters float64
+	// Local date of TodayMeters
+	Today       string
+	TodayMeters float64
+}
+
+func (sr StatsReport) Empty() bool {
+	return len(sr.DataPoints) == 0 && len(sr.Sessions) == 0 && len(sr.Samples) == 0
+}
+
+// Returned by reporters that are still busy with earlier reports, the new one is
+// delivered later with them
+var ErrReporterBusy = errors.New("still delivering earlier reports")
+
+// Somewhere to send the stats to after each minute is saved. Every reporter gets the
+// same reports, and an error from one only affects that one.
+type Reporter interface {
+	// Shown in the logs and the status, e.g. "godoserv http://localhost:8080"
+	Name() string
+	Report(device string, report StatsReport) error
+}
+
+// Reporters that keep what they could not deliver, to tell how much is waiting
+type QueueingReporter interface {
+	Reporter
+	Waiting() int
+}
+
+type ReporterStatus struct {
+	Name       string `json:"name"`
+	LastReport string `json:"lastReport,omitempty"`
+	LastError  string `json:"lastError,omitempty"`
+	Waiting    int    `json:"waiting"`
+}
+
+// A reporter of one monitor, and how it has been doing
+type reporterState struct {
+	reporter Reporter
+	// Reports to the same reporter are sent one at a time and in order
+	reportMutex *sync.Mutex
+	stateMutex  *sync.Mutex
+	lastReport  time.Time
+	lastError   error
+}
+
+func newReporterState(r Reporter) *reporterState {
+	rs := &reporterState{}
+	rs.reporter = r
+	rs.reportMutex = &sync.Mutex{}
+	rs.stateMutex = &sync.Mutex{}
+
+	return rs
+}
+
+func (rs *reporterState) report(device string, report StatsReport) error {
+	rs.reportMutex.Lock()
+	defer rs.reportMutex.Unlock()
+
+	err := rs.reporter.Report(device, report)
+	if err == ErrReporterBusy {
+		// Neither delivered nor failed yet
+		return err
+	}
+
+	rs.stateMutex.Lock()
+	defer rs.stateMutex.Unlock()
+
+	if err != nil {
+		log.Printf("Could not report to %s: %s", rs.reporter.Name(), err)
+		rs.lastError = err
+		return err
+	}
+
+	if rs.lastError != nil {
+		log.Printf("Reporting to %s works again", rs.reporter.Name())
+	}
+	rs.lastError = nil
+	rs.lastReport = time.Now()
+
+	return nil
+}
+
+func (rs *reporterState) status() ReporterStatus {
+	rs.stateMutex.Lock()
+	status := ReporterStatus{Name: rs.reporter.Name()}
+	if !rs.lastReport.IsZero() {
+		status.LastReport = rs.lastReport.In(utc).Format(time.RFC3339)
+	}
+	if rs.lastError != nil {
+		status.LastError = rs.lastError.Error()
+	}
+	rs.stateMutex.Unlock()
+
+	if qr, ok := rs.reporter.(QueueingReporter); ok {
+		status.Waiting = qr.Waiting()
+	}
+
+	return status
+}
+
+// Sends batches from an outbox somewhere, returning the part that was handled there
+type BatchSender interface {
+	Name() string
+	Send(device string, batch OutboxBatch) (OutboxBatch, error)
+}
+
+// Queues reports in an outbox file, so nothing is lost while the destination can't be
+// reached, and delivers them with sender
+type OutboxReporter struct {
+	outbox *Outbox
+	sender BatchSender
+}
+
+func NewOutboxReporter(outboxPath string, sender BatchSender) *OutboxReporter {
+	r := &OutboxReporter{}
+	r.outbox = NewOutbox(outboxPath)
+	r.sender = sender
+
+	return r
+}
+
+func (r *OutboxReporter) Name() string {
+	return r.sender.Name()
+}
+
+func (r *OutboxReporter) Waiting() int {
+	return r.outbox.Len()
+}
+
+func (r *OutboxReporter) Report(device string, report StatsReport) error {
+	r.outbox.Add(report.DataPoints, report.Sessions, report.Samples)
+	return r.deliver(device)
+}
+
+// Send everything in the outbox in batches, stopping at the first failure to try again later
+func (r *OutboxReporter) deliver(device string) error {
+	if !r.outbox.StartSending() {
+		return ErrReporterBusy
+	}
+	defer r.outbox.StopSending()
+
+	for {
+		batch := r.outbox.Batch()
+		if batch.Empty() {
+			return nil
+		}
+
+		handled, err := r.sender.Send(device, batch)
+		if err == nil && handled.Empty() {
+			err = fmt.Errorf("nothing was handled")
+		}
+		if err != nil {
+			return fmt.Errorf("%s, %d things waiting in the outbox to be delivered later", err, r.outbox.Len())
+		}
+
+		r.outbox.Acknowledge(handled)
+	}
+}
+
+// Report to another destination too. A reporter shared by several monitors gets reports
+// from all of them at the same time.
+func (sm *StatsMonitor) AddReporter(r Reporter) {
+	sm.reporters = append(sm.reporters, newReporterState(r))
+}
+
+type reportResult struct {
+	reporter Reporter
+	err      error
+}
+
+// Send to every reporter at the same time, so a slow one doesn't hold up the others
+func (sm *StatsMonitor) report(report StatsReport) {
+	if len(sm.reporters) == 0 {
+		return
+	}
+
+	results := make(chan reportResult, len(sm.reporters))
+	for _, rs := range sm.reporters {
+		go func(rs *reporterState) {
+			results <- reportResult{rs.reporter, rs.report(sm.device, report)}
+		}(rs)
+	}
+
+	// MQTT only gets live data, publishing to it doesn't count as the stats being reported
+	reported := false
+	for range sm.reporters {
+		if r := <-results; r.err == nil && r.reporter != Reporter(sm.mqtt) {
+			reported = true
+		}
+	}
+
+	if !reported {
+		return
+	}
+
+	sm.statsMutex.Lock()
+	sm.lastReport = time.Now()
+	lastReport := sm.lastReport
+	sm.statsMutex.Unlock()
+
+	if sm.mqtt != nil {
+		sm.mqtt.publishReport(sm.device, lastReport)
+	}
+}
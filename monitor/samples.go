@@ -0,0 +1,102 @@
+package monitor
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+// Finer buckets than a minute, e.g. for charting speed within a workout
+type FileSample struct {
+	Timestamp         string  `json:"ts"`
+	Seconds           int     `json:"s"`
+	Meters            float32 `json:"m"`
+	MetersPerSecond   float32 `json:"mps"`
+	KilometersPerHour float32 `json:"kph"`
+}
+
+func (fs FileSample) toAPISample() godometer.UpdateSample {
+	return godometer.UpdateSample{
+		Timestamp:         fs.Timestamp,
+		Seconds:           fs.Seconds,
+		Meters:            fs.Meters,
+		MetersPerSecond:   fs.MetersPerSecond,
+		KilometersPerHour: fs.KilometersPerHour,
+	}
+}
+
+type sampleBucket struct {
+	records  int
+	meters   float64
+	totalMPS float64
+	totalKPH float64
+}
+
+// Collects records in to buckets of resolution by the time of the pulse
+type SampleCollector struct {
+	resolution   time.Duration
+	buckets      map[time.Time]*sampleBucket
+	samplesMutex *sync.Mutex
+}
+
+// Resolution must divide a minute evenly, e.g. 5s, 10s or 15s
+func NewSampleCollector(resolution time.Duration) *SampleCollector {
+	sc := &SampleCollector{}
+	sc.resolution = resolution
+	sc.buckets = map[time.Time]*sampleBucket{}
+	sc.samplesMutex = &sync.Mutex{}
+
+	return sc
+}
+
+func (sc *SampleCollector) add(record GPIORecord) {
+	sc.samplesMutex.Lock()
+	defer sc.samplesMutex.Unlock()
+
+	start := record.Time.Truncate(sc.resolution)
+	bucket, ok := sc.buckets[start]
+	if !ok {
+		bucket = &sampleBucket{}
+		sc.buckets[start] = bucket
+	}
+
+	bucket.records += 1
+	bucket.meters += record.Meters
+	bucket.totalMPS += record.MetersPerSecond
+	bucket.totalKPH += record.KilometersPerHour
+}
+
+// Finish the buckets that have ended by now, or all of them when quitting
+func (sc *SampleCollector) collect(now time.Time, all bool) []FileSample {
+	sc.samplesMutex.Lock()
+	defer sc.samplesMutex.Unlock()
+
+	var starts []time.Time
+	for start := range sc.buckets {
+		if all || !start.Add(sc.resolution).After(now) {
+			starts = append(starts, start)
+		}
+	}
+
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+
+	samples := []FileSample{}
+	for _, start := range starts {
+		bucket := sc.buckets[start]
+		delete(sc.buckets, start)
+
+		samples = append(samples, FileSample{
+			Timestamp:         start.In(utc).Format(godometer.APISampleTimeLayout),
+			Seconds:           int(sc.resolution.Seconds()),
+			Meters:            float32(bucket.meters),
+			MetersPerSecond:   float32(bucket.totalMPS / float64(bucket.records)),
+			KilometersPerHour: float32(bucket.totalKPH / float64(bucket.records)),
+		})
+	}
+
+	return samples
+}
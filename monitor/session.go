@@ -0,0 +1,208 @@
+package monitor
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lietu/godometer"
+)
+
+// Movement needs to go on for this long without pausing to count as a session starting
+const sustainedMovement = 30 * time.Second
+
+type FileSession struct {
+	Start                string  `json:"start"`
+	End                  string  `json:"end"`
+	MovingSeconds        float32 `json:"mv"`
+	Meters               float32 `json:"m"`
+	MetersPerSecond      float32 `json:"mps"`
+	KilometersPerHour    float32 `json:"kph"`
+	MaxMetersPerSecond   float32 `json:"maxMps"`
+	MaxKilometersPerHour float32 `json:"maxKph"`
+}
+
+func (fs FileSession) toAPISession() godometer.UpdateSession {
+	return godometer.UpdateSession{
+		Start:                fs.Start,
+		End:                  fs.End,
+		MovingSeconds:        fs.MovingSeconds,
+		Meters:               fs.Meters,
+		MetersPerSecond:      fs.MetersPerSecond,
+		KilometersPerHour:    fs.KilometersPerHour,
+		MaxMetersPerSecond:   fs.MaxMetersPerSecond,
+		MaxKilometersPerHour: fs.MaxKilometersPerHour,
+	}
+}
+
+// Groups movement in to workout sessions. A session starts once there has been
+// sustainedMovement of movement, and ends after idleGap without any.
+type SessionTracker struct {
+	path          string
+	idleAfter     time.Duration
+	idleGap       time.Duration
+	active        bool
+	start         time.Time
+	lastRecord    time.Time
+	lastUpdate    time.Time
+	movingTime    time.Duration
+	meters        float64
+	maxMPS        float64
+	finished      []FileSession
+	sessionsMutex *sync.Mutex
+}
+
+func NewSessionTracker(dbPath string, idleAfter time.Duration, idleGap time.Duration) *SessionTracker {
+	st := &SessionTracker{}
+	st.path = siblingPath(dbPath, "sessions")
+	st.idleAfter = idleAfter
+	st.idleGap = idleGap
+	st.finished = []FileSession{}
+	st.sessionsMutex = &sync.Mutex{}
+
+	return st
+}
+
+func (st *SessionTracker) reset() {
+	st.active = false
+	st.start = time.Time{}
+	st.lastRecord = time.Time{}
+	st.movingTime = 0
+	st.meters = 0.0
+	st.maxMPS = 0.0
+}
+
+// Record should have the smoothed speed to avoid single noisy pulses becoming the max speed
+func (st *SessionTracker) update(record GPIORecord) {
+	st.sessionsMutex.Lock()
+	defer st.sessionsMutex.Unlock()
+
+	if !st.lastRecord.IsZero() {
+		gap := record.Time.Sub(st.lastRecord)
+		if gap > st.idleGap {
+			st.finish()
+		} else if !st.active && gap > st.idleAfter {
+			// Paused before the movement was sustained, start over
+			st.reset()
+		} else if gap <= st.idleAfter {
+			st.movingTime += gap
+		}
+	}
+
+	if st.start.IsZero() {
+		st.start = record.Time
+	}
+
+	st.lastRecord = record.Time
+	st.lastUpdate = time.Now()
+	st.meters += record.Meters
+	if record.MetersPerSecond > st.maxMPS {
+		st.maxMPS = record.MetersPerSecond
+	}
+
+	if !st.active && st.movingTime >= sustainedMovement {
+		st.active = true
+		log.Printf("Session started at %s", st.start.In(utc).Format(time.RFC3339))
+	}
+}
+
+// End the current session if it has been idle long enough
+func (st *SessionTracker) checkEnd() {
+	st.sessionsMutex.Lock()
+	defer st.sessionsMutex.Unlock()
+
+	if !st.lastRecord.IsZero() && time.Since(st.lastUpdate) > st.idleGap {
+		st.finish()
+	}
+}
+
+// End the current session right away, e.g. when quitting
+func (st *SessionTracker) Finish() {
+	st.sessionsMutex.Lock()
+	defer st.sessionsMutex.Unlock()
+
+	st.finish()
+}
+
+// The ongoing session so far, if there is one
+func (st *SessionTracker) current() (FileSession, bool) {
+	st.sessionsMutex.Lock()
+	defer st.sessionsMutex.Unlock()
+
+	if !st.active {
+		return FileSession{}, false
+	}
+	return st.summary(), true
+}
+
+func (st *SessionTracker) finish() {
+	defer st.reset()
+
+	if !st.active {
+		return
+	}
+
+	session := st.summary()
+	log.Printf("Session finished: %.0fm in %.0fs moving, %.1fkm/h average", session.Meters, session.MovingSeconds, session.KilometersPerHour)
+
+	st.finished = append(st.finished, session)
+	st.appendSession(session)
+}
+
+func (st *SessionTracker) summary() FileSession {
+	session := FileSession{
+		Start:                st.start.In(utc).Format(time.RFC3339),
+		End:                  st.lastRecord.In(utc).Format(time.RFC3339),
+		MovingSeconds:        float32(st.movingTime.Seconds()),
+		Meters:               float32(st.meters),
+		MaxMetersPerSecond:   float32(st.maxMPS),
+		MaxKilometersPerHour: float32(st.maxMPS * 3600.0 / 1000.0),
+	}
+
+	if st.movingTime > 0 {
+		mps := st.meters / st.movingTime.Seconds()
+		session.MetersPerSecond = float32(mps)
+		session.KilometersPerHour = float32(mps * 3600.0 / 1000.0)
+	}
+
+	return session
+}
+
+// Sessions finished since last asked, for reporting
+func (st *SessionTracker) takeFinished() []FileSession {
+	st.sessionsMutex.Lock()
+	defer st.sessionsMutex.Unlock()
+
+	finished := st.finished
+	st.finished = []FileSession{}
+	return finished
+}
+
+// All sessions are kept in the file
+func (st *SessionTracker) appendSession(session FileSession) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		log.Printf("Could not marshal session: %s. This should not happen.", err)
+		return
+	}
+
+	file, err := os.OpenFile(st.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("Could not write to %s: %s", st.path, err)
+		return
+	}
+
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			log.Printf("Error closing %s: %s", st.path, err)
+		}
+	}()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Could not write to %s: %s", st.path, err)
+	}
+}
@@ -0,0 +1,75 @@
+package monitor
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// Generates pulses as if a wheel was rotating at roughly the given speed, for
+// developing and testing without GPIO hardware
+type SimulatedSource struct {
+	kilometersPerHour        float64
+	variation                float64
+	wheelCircumferenceMeters float64
+	pulsesPerRevolution      int
+}
+
+// Variation is the maximum random change to the speed per revolution, e.g. 0.1 for +-10%
+func NewSimulatedSource(kilometersPerHour float64, variation float64, wheelCircumferenceMeters float64, pulsesPerRevolution int) *SimulatedSource {
+	if pulsesPerRevolution < 1 {
+		pulsesPerRevolution = 1
+	}
+
+	ss := &SimulatedSource{}
+	ss.kilometersPerHour = kilometersPerHour
+	ss.variation = variation
+	ss.wheelCircumferenceMeters = wheelCircumferenceMeters
+	ss.pulsesPerRevolution = pulsesPerRevolution
+
+	return ss
+}
+
+func (ss *SimulatedSource) pulseTime() time.Duration {
+	kph := ss.kilometersPerHour * (1.0 + (rand.Float64()*2.0-1.0)*ss.variation)
+
+	mps := kph * 1000.0 / 3600.0
+	meters := ss.wheelCircumferenceMeters / float64(ss.pulsesPerRevolution)
+	return time.Duration(meters / mps * float64(time.Second))
+}
+
+func (ss *SimulatedSource) Monitor(ctx context.Context, handler PulseHandler) error {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	// The simulated magnet keeps the sensor active for half of each pulse
+	var pulseTime time.Duration
+
+	edge := FallingEdge
+	for {
+		select {
+		case now := <-timer.C:
+			if edge == FallingEdge {
+				if ss.kilometersPerHour <= 0 {
+					// Standing still, check again in a while
+					timer.Reset(time.Second)
+					continue
+				}
+
+				edge = RisingEdge
+				handler(Pulse{Time: now, Edge: edge})
+				pulseTime = ss.pulseTime()
+				timer.Reset(pulseTime / 2)
+				continue
+			}
+
+			edge = FallingEdge
+			handler(Pulse{Time: now, Edge: edge})
+
+			timer.Reset(pulseTime - pulseTime/2)
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
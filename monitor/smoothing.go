@@ -0,0 +1,218 @@
+package monitor
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Smooths the speed of consecutive records for a steadier live readout
+type SpeedFilter interface {
+	// Add a new speed in m/s, returns the smoothed speed
+	Update(t time.Time, mps float64) float64
+	// Forget the history, e.g. after stopping
+	Reset()
+}
+
+// Average of the last samples, the more samples the steadier and slower to react
+type MovingAverageFilter struct {
+	samples int
+	history []float64
+}
+
+func NewMovingAverageFilter(samples int) *MovingAverageFilter {
+	f := &MovingAverageFilter{}
+	f.samples = samples
+	f.history = []float64{}
+
+	return f
+}
+
+func (f *MovingAverageFilter) Update(t time.Time, mps float64) float64 {
+	f.history = keepLast(append(f.history, mps), f.samples)
+
+	total := 0.0
+	for _, h := range f.history {
+		total += h
+	}
+
+	return total / float64(len(f.history))
+}
+
+func (f *MovingAverageFilter) Reset() {
+	f.history = []float64{}
+}
+
+// Exponential moving average, alpha between 0 and 1 is how much weight a new sample gets
+type ExponentialFilter struct {
+	alpha   float64
+	current float64
+	started bool
+}
+
+func NewExponentialFilter(alpha float64) *ExponentialFilter {
+	f := &ExponentialFilter{}
+	f.alpha = alpha
+
+	return f
+}
+
+func (f *ExponentialFilter) Update(t time.Time, mps float64) float64 {
+	if !f.started {
+		f.current = mps
+		f.started = true
+	} else {
+		f.current = f.alpha*mps + (1-f.alpha)*f.current
+	}
+
+	return f.current
+}
+
+func (f *ExponentialFilter) Reset() {
+	f.current = 0.0
+	f.started = false
+}
+
+// Median of the last samples, ignores single odd values completely
+type MedianFilter struct {
+	samples int
+	history []float64
+}
+
+func NewMedianFilter(samples int) *MedianFilter {
+	f := &MedianFilter{}
+	f.samples = samples
+	f.history = []float64{}
+
+	return f
+}
+
+func (f *MedianFilter) Update(t time.Time, mps float64) float64 {
+	f.history = keepLast(append(f.history, mps), f.samples)
+
+	sorted := make([]float64, len(f.history))
+	copy(sorted, f.history)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+func (f *MedianFilter) Reset() {
+	f.history = []float64{}
+}
+
+// One dimensional Kalman filter assuming a roughly constant speed. Process noise is
+// how much the speed is expected to change per second, measurement noise how much
+// the measured speeds jump around, both as variances in (m/s)².
+type KalmanFilter struct {
+	processNoise     float64
+	measurementNoise float64
+	estimate         float64
+	variance         float64
+	last             time.Time
+	started          bool
+}
+
+func NewKalmanFilter(processNoise float64, measurementNoise float64) *KalmanFilter {
+	f := &KalmanFilter{}
+	f.processNoise = processNoise
+	f.measurementNoise = measurementNoise
+
+	return f
+}
+
+func (f *KalmanFilter) Update(t time.Time, mps float64) float64 {
+	if !f.started {
+		f.estimate = mps
+		f.variance = f.measurementNoise
+		f.last = t
+		f.started = true
+		return f.estimate
+	}
+
+	// Predict, the longer since the last sample the less we know
+	dt := t.Sub(f.last).Seconds()
+	if dt > 0 {
+		f.variance += f.processNoise * dt
+	}
+	f.last = t
+
+	// Correct with the new measurement
+	gain := f.variance / (f.variance + f.measurementNoise)
+	f.estimate += gain * (mps - f.estimate)
+	f.variance *= 1 - gain
+
+	return f.estimate
+}
+
+func (f *KalmanFilter) Reset() {
+	f.estimate = 0.0
+	f.variance = 0.0
+	f.last = time.Time{}
+	f.started = false
+}
+
+func keepLast(values []float64, count int) []float64 {
+	if len(values) > count {
+		return values[len(values)-count:]
+	}
+	return values
+}
+
+// Parse a filter from e.g. "average:3", "ema:0.3", "median:5" or "kalman:0.05:0.1",
+// the parameters are optional
+func ParseSpeedFilter(s string) (SpeedFilter, error) {
+	parts := strings.Split(s, ":")
+	name := parts[0]
+	var params []float64
+	for _, p := range parts[1:] {
+		f, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameter %q for %s filter", p, name)
+		}
+		params = append(params, f)
+	}
+
+	param := func(i int, def float64) float64 {
+		if i < len(params) {
+			return params[i]
+		}
+		return def
+	}
+
+	switch name {
+	case "average":
+		samples := int(param(0, averageOverMeasurements))
+		if samples < 1 || len(params) > 1 {
+			return nil, fmt.Errorf("average filter takes a positive number of samples")
+		}
+		return NewMovingAverageFilter(samples), nil
+	case "ema":
+		alpha := param(0, 0.3)
+		if alpha <= 0 || alpha > 1 || len(params) > 1 {
+			return nil, fmt.Errorf("ema filter takes an alpha between 0 and 1")
+		}
+		return NewExponentialFilter(alpha), nil
+	case "median":
+		samples := int(param(0, 5))
+		if samples < 1 || len(params) > 1 {
+			return nil, fmt.Errorf("median filter takes a positive number of samples")
+		}
+		return NewMedianFilter(samples), nil
+	case "kalman":
+		processNoise := param(0, 0.05)
+		measurementNoise := param(1, 0.1)
+		if processNoise <= 0 || measurementNoise <= 0 || len(params) > 2 {
+			return nil, fmt.Errorf("kalman filter takes positive process and measurement noise")
+		}
+		return NewKalmanFilter(processNoise, measurementNoise), nil
+	}
+
+	return nil, fmt.Errorf("unknown speed filter %q, expected average, ema, median or kalman", name)
+}
@@ -0,0 +1,52 @@
+package monitor
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSpeedFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   SpeedFilter
+	}{
+		{"average", NewMovingAverageFilter(averageOverMeasurements)},
+		{"average:3", NewMovingAverageFilter(3)},
+		{"ema", NewExponentialFilter(0.3)},
+		{"ema:0.5", NewExponentialFilter(0.5)},
+		{"median:7", NewMedianFilter(7)},
+		{"kalman", NewKalmanFilter(0.05, 0.1)},
+		{"kalman:0.2", NewKalmanFilter(0.2, 0.1)},
+		{"kalman:0.2:0.3", NewKalmanFilter(0.2, 0.3)},
+	}
+
+	for _, test := range tests {
+		got, err := ParseSpeedFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.filter, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: expected %#v, got %#v", test.filter, test.want, got)
+		}
+	}
+}
+
+func TestParseSpeedFilterInvalid(t *testing.T) {
+	for _, filter := range []string{
+		"",
+		"unknown",
+		"average:0",
+		"average:3:4",
+		"ema:0",
+		"ema:1.5",
+		"ema:x",
+		"median:-1",
+		"kalman:0",
+		"kalman:0.1:0.1:0.1",
+	} {
+		if _, err := ParseSpeedFilter(filter); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
@@ -1,14 +1,12 @@
 package monitor
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
+	"context"
 	"log"
-	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -17,20 +15,30 @@ import (
 
 const statsDebug = false
 
-// Keep this many measurements and average m/s and km/h over them for less variation
+// By default keep this many measurements and average m/s and km/h over them for less variation
 const averageOverMeasurements = 3
 
-// Store and send this many dataPoints to ensure they get eventually delivered
+// Keep this many dataPoints in the local DB, to update them when restarting within the same minute
 const keepPastDataPoints = 5
 
+// Pulses from the end of a minute can still be on their way, wait this long before saving it
+const minuteGrace = 2 * time.Second
+
+// Most empty minutes to save in one go, more than this means the clock jumped
+const maxEmptyMinutes = 5
+
 var utc, _ = time.LoadLocation("UTC")
 
+const dayLayout = "2006-01-02"
+
 type FileDataPoint struct {
 	Timestamp         string  `json:"ts"`
 	Meters            float32 `json:"m"`
 	MetersPerSecond   float32 `json:"mps"`
 	KilometersPerHour float32 `json:"kph"`
 	TotalMeters       float64 `json:"tm"`
+	MovingSeconds     float32 `json:"mv"`
+	IdleSeconds       float32 `json:"id"`
 }
 
 func (fdp FileDataPoint) toAPIDataPoint() godometer.UpdateDataPoint {
@@ -42,184 +50,312 @@ func (fdp FileDataPoint) toAPIDataPoint() godometer.UpdateDataPoint {
 	}
 }
 
+// Records of one minute on the clock
+type minuteBucket struct {
+	records    []GPIORecord
+	movingTime time.Duration
+}
+
 type StatsData struct {
-	GPIORecords []GPIORecord
-	dataPoints  []FileDataPoint
+	// Minutes by their start that have not been saved yet
+	buckets    map[time.Time]*minuteBucket
+	dataPoints []FileDataPoint
+	started    time.Time
+	// Start of the first minute that has not been saved yet
+	nextMinute  time.Time
+	savedMeters float64
 }
 
 func NewStatsData() StatsData {
+	now := time.Now()
 	return StatsData{
-		GPIORecords: []GPIORecord{},
+		buckets:     map[time.Time]*minuteBucket{},
 		dataPoints:  []FileDataPoint{},
+		started:     now,
+		nextMinute:  now.Truncate(time.Minute),
+		savedMeters: 0.0,
+	}
+}
+
+// Bucket of the minute t is in
+func (sd *StatsData) bucket(t time.Time) *minuteBucket {
+	start := t.Truncate(time.Minute)
+	b, ok := sd.buckets[start]
+	if !ok {
+		b = &minuteBucket{}
+		sd.buckets[start] = b
+	}
+
+	return b
+}
+
+// Split time spent moving between the minutes it happened in
+func (sd *StatsData) addMovingTime(from time.Time, to time.Time) {
+	for from.Before(to) {
+		end := from.Truncate(time.Minute).Add(time.Minute)
+		if end.After(to) {
+			end = to
+		}
+
+		sd.bucket(from).movingTime += end.Sub(from)
+		from = end
 	}
 }
 
 type StatsMonitor struct {
 	results             chan GPIORecord
-	apiBaseUrl          string
-	apiAuth             string
+	device              string
 	dbPath              string
-	metersTraveled      float64
+	db                  *LocalDB
+	archive             *Archive
 	totalMetersTraveled float64
 	currentMPS          float64
 	currentKPH          float64
-	averageResults      []GPIORecord
+	moving              bool
+	idleAfter           time.Duration
+	lastPulse           time.Time
+	lastUpdate          time.Time
+	lastReport          time.Time
+	lastAlive           time.Time
+	tripStart           time.Time
+	tripMeters          float64
+	tripMovingTime      time.Duration
+	today               string
+	todayMeters         float64
+	filter              SpeedFilter
+	sessions            *SessionTracker
+	samples             *SampleCollector
+	reporters           []*reporterState
+	counterSources      []CounterSource
+	mqtt                *MQTTReporter
+	influx              *InfluxReporter
 	stats               StatsData
 	statsMutex          *sync.Mutex
+	// Saves write the local DB and the archive, they run one at a time
+	saveMutex *sync.Mutex
 }
 
-func NewStatsMonitor(results chan GPIORecord, dbPath string, apiBaseUrl string, apiAuth string) *StatsMonitor {
+// Speed drops to zero and time is counted as idle after idleAfter without any records,
+// a workout session ends after sessionIdleGap without any. Device identifies the input when
+// reporting, leave empty when there is only one. The filter smooths out the speed. Records
+// are also collected in to samples of sampleResolution when it's not zero. Stats are only
+// saved locally until reporters are added.
+func NewStatsMonitor(results chan GPIORecord, filter SpeedFilter, idleAfter time.Duration, sessionIdleGap time.Duration, sampleResolution time.Duration, device string, dbPath string) *StatsMonitor {
 	sm := &StatsMonitor{}
 	sm.results = results
+	sm.filter = filter
+	sm.device = device
+	sm.idleAfter = idleAfter
+	sm.sessions = NewSessionTracker(dbPath, idleAfter, sessionIdleGap)
+	if sampleResolution > 0 {
+		sm.samples = NewSampleCollector(sampleResolution)
+	}
 	sm.dbPath = dbPath
-	sm.apiBaseUrl = apiBaseUrl
-	sm.apiAuth = apiAuth
-	sm.metersTraveled = 0.0
+	sm.db = NewLocalDB(dbPath)
+	sm.archive = NewArchive(dbPath)
 	sm.totalMetersTraveled = 0.0
 	sm.currentMPS = 0.0
 	sm.currentKPH = 0.0
+	sm.tripStart = time.Now()
+	sm.lastAlive = time.Now()
 	sm.stats = NewStatsData()
 	sm.statsMutex = &sync.Mutex{}
+	sm.saveMutex = &sync.Mutex{}
 	sm.readLocalDB()
+	sm.stats.savedMeters = sm.totalMetersTraveled
+
+	now := time.Now()
+	sm.today = now.Format(dayLayout)
+	sm.todayMeters = sm.archive.metersOn(now)
 	return sm
 }
 
-func (sm *StatsMonitor) update(result GPIORecord) {
-	results := len(sm.averageResults) + 1
-	totalMPS := result.MetersPerSecond
-	totalKPH := result.KilometersPerHour
-
-	for _, r := range sm.averageResults {
-		totalMPS += r.MetersPerSecond
-		totalKPH += r.KilometersPerHour
-	}
-
-	currentMPS := totalMPS / float64(results)
-	currentKPH := totalKPH / float64(results)
+// Also publish to an MQTT broker, can be shared by several monitors. It gets the reports
+// like the other reporters, and the live speed.
+func (sm *StatsMonitor) SetMQTTReporter(r *MQTTReporter) {
+	sm.mqtt = r
+	r.addDevice(sm.device)
+	sm.AddReporter(r)
+}
 
-	keepFrom := 0
-	if results > averageOverMeasurements {
-		keepFrom = results - averageOverMeasurements
-	}
+// Also write to InfluxDB, can be shared by several monitors. It gets the reports like the
+// other reporters, and optionally every pulse.
+func (sm *StatsMonitor) SetInfluxReporter(r *InfluxReporter) {
+	sm.influx = r
+	sm.AddReporter(r)
+}
 
-	sm.averageResults = append(sm.averageResults, result)[keepFrom:]
+func (sm *StatsMonitor) update(result GPIORecord) {
+	currentMPS := sm.filter.Update(result.Time, result.MetersPerSecond)
+	currentKPH := currentMPS * 3600.0 / 1000.0
 
 	newRecord := GPIORecord{
+		Time:              result.Time,
 		Meters:            result.Meters,
 		MetersPerSecond:   currentMPS,
 		KilometersPerHour: currentKPH,
+		Direction:         result.Direction,
+	}
+
+	sm.sessions.update(newRecord)
+	if sm.samples != nil {
+		sm.samples.add(newRecord)
+	}
+
+	if sm.mqtt != nil {
+		sm.mqtt.publishSpeed(sm.device, time.Now(), true, currentMPS, currentKPH)
+	}
+	if sm.influx != nil {
+		sm.influx.addPulse(sm.device, result)
 	}
 
+	// The live stats are read by the status server too, so everything needs mutexing
+	sm.statsMutex.Lock()
+	defer sm.statsMutex.Unlock()
+
 	// Update live stats
 	sm.totalMetersTraveled += result.Meters
+	sm.tripMeters += result.Meters
+	sm.addTodayMeters(result.Time, result.Meters)
 	sm.currentMPS = currentMPS
 	sm.currentKPH = currentKPH
+	sm.moving = true
+	sm.lastUpdate = time.Now()
+
+	// Time between pulses close enough to each other was spent moving
+	if !sm.lastPulse.IsZero() {
+		gap := result.Time.Sub(sm.lastPulse)
+		if gap > 0 && gap <= sm.idleAfter {
+			sm.stats.addMovingTime(sm.lastPulse, result.Time)
+			sm.tripMovingTime += gap
+		}
+	}
+	sm.lastPulse = result.Time
+
+	// Pulses count for the minute they happened in, even if saving it is already due
+	bucket := sm.stats.bucket(result.Time)
+	bucket.records = append(bucket.records, newRecord)
+}
 
-	// Then the periodical stats that require mutexing
+// Distance on the current local day, starts from zero at midnight
+func (sm *StatsMonitor) addTodayMeters(t time.Time, meters float64) {
+	day := t.Local().Format(dayLayout)
+	if day != sm.today {
+		sm.today = day
+		sm.todayMeters = 0.0
+	}
+	sm.todayMeters += meters
+}
+
+// Drop the speed to zero when there haven't been any pulses in a while
+func (sm *StatsMonitor) checkIdle() {
 	sm.statsMutex.Lock()
-	defer sm.statsMutex.Unlock()
+	if !sm.moving || time.Since(sm.lastUpdate) <= sm.idleAfter {
+		sm.statsMutex.Unlock()
+		return
+	}
+
+	sm.moving = false
+	sm.currentMPS = 0.0
+	sm.currentKPH = 0.0
+	sm.filter.Reset()
+	sm.statsMutex.Unlock()
 
-	sm.metersTraveled += result.Meters
-	sm.stats.GPIORecords = append(sm.stats.GPIORecords, newRecord)
+	if sm.mqtt != nil {
+		sm.mqtt.publishSpeed(sm.device, time.Now(), false, 0.0, 0.0)
+	}
+}
+
+// Other files are stored next to the local DB, e.g. godometer.txt -> godometer-sessions.txt
+func siblingPath(dbPath string, name string) string {
+	ext := filepath.Ext(dbPath)
+	return strings.TrimSuffix(dbPath, ext) + "-" + name + ext
 }
 
 func (sm *StatsMonitor) readLocalDB() {
-	if _, err := os.Stat(sm.dbPath); err != nil {
+	dataPoints, err := sm.db.Read()
+	if err != nil {
 		if os.IsNotExist(err) {
 			// No old data yet, this is fine
 			log.Printf("No old data found from %s", sm.dbPath)
 			return
 		}
 
-		// Something else went wrong, this might not be fine.
-		log.Printf("Uh oh, could not read %s: %s", sm.dbPath, err)
-		return
-	}
-
-	file, err := os.Open(sm.dbPath)
-	if err != nil {
+		// Something else went wrong, this might not be fine. Use whatever could be read.
 		log.Printf("Uh oh, could not read %s: %s", sm.dbPath, err)
-		return
 	}
 
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Printf("Error closing %s: %s", sm.dbPath, err)
-		}
-	}()
-
-	scanner := bufio.NewScanner(file)
-	lineno := 0
-	for scanner.Scan() {
-		lineno += 1
-		line := scanner.Bytes()
-
-		fdp := FileDataPoint{}
-		err := json.Unmarshal(line, &fdp)
-		if err != nil {
-			log.Printf("Error reading %s line %d: %s", sm.dbPath, lineno, err)
-			continue
-		}
-
+	for _, fdp := range dataPoints {
 		if fdp.TotalMeters > sm.totalMetersTraveled {
 			sm.totalMetersTraveled = fdp.TotalMeters
 		}
-
-		sm.stats.dataPoints = append(sm.stats.dataPoints, fdp)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Printf("Error parsing old data from %s: %s", sm.dbPath, err)
 	}
 
 	keepFrom := 0
-	rows := len(sm.stats.dataPoints)
+	rows := len(dataPoints)
 	if rows > keepPastDataPoints {
 		keepFrom = rows - keepPastDataPoints
 	}
 
-	sm.stats.dataPoints = sm.stats.dataPoints[keepFrom:]
+	sm.stats.dataPoints = append(sm.stats.dataPoints, dataPoints[keepFrom:]...)
 	log.Printf("Read %d old records from %s", len(sm.stats.dataPoints), sm.dbPath)
-}
 
-func (sm *StatsMonitor) writeLocalDB(rows []FileDataPoint) {
-	contents := ""
-	for _, row := range rows {
-		data, err := json.Marshal(row)
-		if err != nil {
-			// Fingers crossed, maybe this will fix itself.
-			log.Printf("Could not marshal row: %s. This should not happen.", err)
-			return
-		}
-
-		contents += string(data[:]) + "\n"
+	// Start from a clean file, this also drops damaged records and converts the old format
+	if len(dataPoints) > 0 {
+		sm.compactLocalDB(sm.stats.dataPoints)
 	}
+}
 
-	err := ioutil.WriteFile(sm.dbPath, []byte(contents), 0600)
+// Appends the updated rows, and rewrites the file with only the kept ones once it grows
+func (sm *StatsMonitor) writeLocalDB(updated []FileDataPoint, kept []FileDataPoint) {
+	err := sm.db.Append(updated)
 	if err != nil {
 		// Can't write to disk. Let's try to not panic and pretend someone will fix this.
 		log.Printf("Could not write to %s: %s", sm.dbPath, err)
 		return
 	}
+
+	if sm.db.NeedsCompaction() {
+		sm.compactLocalDB(kept)
+	}
 }
 
-func (sm *StatsMonitor) saveStats() {
-	// Get latest stats and replace container
-	sm.statsMutex.Lock()
+func (sm *StatsMonitor) compactLocalDB(rows []FileDataPoint) {
+	err := sm.db.Compact(rows)
+	if err != nil {
+		// The old file is still intact, try again later
+		log.Printf("Could not compact %s: %s", sm.dbPath, err)
+	}
+}
 
-	records := float64(len(sm.stats.GPIORecords))
+// Keeps the full history, unlike the local DB
+func (sm *StatsMonitor) archiveDataPoints(rows []FileDataPoint, now time.Time) {
+	err := sm.archive.Append(rows)
+	if err != nil {
+		log.Printf("Could not archive data points: %s", err)
+	}
+
+	sm.archive.Rotate(now)
+}
 
+// Data point for one minute, end is earlier than the end of the minute when quitting
+func (sm *StatsMonitor) minuteDataPoint(start time.Time, end time.Time, bucket *minuteBucket) FileDataPoint {
+	records := 0.0
 	recordMeters := 0.0
 	totalMPS := 0.0
 	totalKPH := 0.0
 	avgMPS := 0.0
 	avgKPH := 0.0
-
-	for _, r := range sm.stats.GPIORecords {
-		recordMeters += r.Meters
-		totalMPS += r.MetersPerSecond
-		totalKPH += r.KilometersPerHour
+	moving := time.Duration(0)
+
+	if bucket != nil {
+		records = float64(len(bucket.records))
+		moving = bucket.movingTime
+		for _, r := range bucket.records {
+			recordMeters += r.Meters
+			totalMPS += r.MetersPerSecond
+			totalKPH += r.KilometersPerHour
+		}
 	}
 
 	if records > 0.0 {
@@ -227,106 +363,230 @@ func (sm *StatsMonitor) saveStats() {
 		avgKPH = totalKPH / records
 	}
 
-	latest := FileDataPoint{
-		TotalMeters:       sm.totalMetersTraveled,
-		Timestamp:         time.Now().In(utc).Format(godometer.APITimeLayout),
+	// Only count the part of the first minute we were running for
+	from := start
+	if sm.stats.started.After(start) && sm.stats.started.Before(end) {
+		from = sm.stats.started
+	}
+
+	period := end.Sub(from)
+	if moving > period {
+		moving = period
+	}
+
+	sm.stats.savedMeters += recordMeters
+
+	return FileDataPoint{
+		TotalMeters:       sm.stats.savedMeters,
+		Timestamp:         start.In(utc).Format(godometer.APITimeLayout),
 		Meters:            float32(recordMeters),
 		MetersPerSecond:   float32(avgMPS),
 		KilometersPerHour: float32(avgKPH),
+		MovingSeconds:     float32(moving.Seconds()),
+		IdleSeconds:       float32((period - moving).Seconds()),
+	}
+}
+
+// Same timestamp from past records, e.g. after restarting or pulses arriving late
+func mergeDataPoints(r FileDataPoint, latest FileDataPoint) FileDataPoint {
+	moving := r.MovingSeconds + latest.MovingSeconds
+	if moving > 0 {
+		r.MetersPerSecond = (r.MetersPerSecond*r.MovingSeconds + latest.MetersPerSecond*latest.MovingSeconds) / moving
+		r.KilometersPerHour = (r.KilometersPerHour*r.MovingSeconds + latest.KilometersPerHour*latest.MovingSeconds) / moving
+	} else {
+		r.MetersPerSecond = (r.MetersPerSecond + latest.MetersPerSecond) / 2
+		r.KilometersPerHour = (r.KilometersPerHour + latest.KilometersPerHour) / 2
 	}
+	r.Meters = r.Meters + latest.Meters
+	r.MovingSeconds = moving
+	r.IdleSeconds = r.IdleSeconds + latest.IdleSeconds
+	if latest.TotalMeters > r.TotalMeters {
+		r.TotalMeters = latest.TotalMeters
+	}
+
+	return r
+}
+
+// Save the minutes on the clock that have ended, final is set when quitting to also
+// save the current one
+func (sm *StatsMonitor) saveStats(final bool) {
+	// A save that takes long, e.g. waiting for a reporter, delays the next one and the
+	// final save waits for it
+	sm.saveMutex.Lock()
+	defer sm.saveMutex.Unlock()
 
-	latestAdded := false
-	dataPoints := []FileDataPoint{}
-	for _, r := range sm.stats.dataPoints {
-		if r.Timestamp == latest.Timestamp {
-			// Same timestamp from past records, update instead of creating a new one.
-			// Can easily happen if restarting quickly.
-			r.Meters = r.Meters + latest.Meters
-			r.MetersPerSecond = (r.MetersPerSecond + latest.MetersPerSecond) / 2
-			r.KilometersPerHour = (r.KilometersPerHour + latest.KilometersPerHour) / 2
-			latestAdded = true
-			dataPoints = append(dataPoints, r)
-		} else {
-			dataPoints = append(dataPoints, r)
+	// Get finished minutes and remove them from the buckets
+	sm.statsMutex.Lock()
+
+	now := time.Now()
+	cutoff := now.Add(-minuteGrace)
+	if final {
+		cutoff = now.Truncate(time.Minute).Add(time.Minute)
+	}
+
+	// Every minute gets a data point, also ones without any movement
+	minutes := map[time.Time]bool{}
+	next := sm.stats.nextMinute
+	// The clock jumped, e.g. NTP setting the time on a Pi without a RTC. Minutes with
+	// pulses are still saved below, the empty ones in between are skipped.
+	if skipTo := cutoff.Truncate(time.Minute).Add(-maxEmptyMinutes * time.Minute); next.Before(skipTo) {
+		log.Printf("Clock jumped from %s to %s, not saving the empty minutes in between", next.Format(time.RFC3339), now.Format(time.RFC3339))
+		next = skipTo
+	}
+	for ; !next.Add(time.Minute).After(cutoff); next = next.Add(time.Minute) {
+		minutes[next] = true
+	}
+	sm.stats.nextMinute = next
+
+	// Late pulses for minutes already saved get merged to them
+	for start := range sm.stats.buckets {
+		if start.Before(next) {
+			minutes[start] = true
 		}
 	}
 
-	if !latestAdded {
-		dataPoints = append(dataPoints, latest)
+	var starts []time.Time
+	for start := range minutes {
+		starts = append(starts, start)
+	}
+
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+
+	dataPoints := sm.stats.dataPoints
+	updated := []FileDataPoint{}
+	for _, start := range starts {
+		end := start.Add(time.Minute)
+		if end.After(now) {
+			end = now
+		}
+
+		latest := sm.minuteDataPoint(start, end, sm.stats.buckets[start])
+		delete(sm.stats.buckets, start)
+
+		if statsDebug {
+			log.Printf("Saving %s: %.1fm @ %.1fm/s or %.1fkm/h, %.0fs moving and %.0fs idle", latest.Timestamp, latest.Meters, latest.MetersPerSecond, latest.KilometersPerHour, latest.MovingSeconds, latest.IdleSeconds)
+		}
+
+		latestAdded := false
+		for i, r := range dataPoints {
+			if r.Timestamp == latest.Timestamp {
+				dataPoints[i] = mergeDataPoints(r, latest)
+				updated = append(updated, dataPoints[i])
+				latestAdded = true
+			}
+		}
+
+		if !latestAdded {
+			dataPoints = append(dataPoints, latest)
+			updated = append(updated, latest)
+		}
 	}
 
-	sm.stats = NewStatsData()
 	keepFrom := 0
 	dataPointCount := len(dataPoints)
 	if dataPointCount > keepPastDataPoints {
 		keepFrom = dataPointCount - keepPastDataPoints
 	}
 
-	sm.stats.dataPoints = dataPoints[keepFrom:]
-	sm.metersTraveled = 0.0
+	dataPoints = dataPoints[keepFrom:]
+	sm.stats.dataPoints = dataPoints
+	totalMeters := sm.totalMetersTraveled
+	sm.addTodayMeters(now, 0.0)
+	today := sm.today
+	todayMeters := sm.todayMeters
 	sm.statsMutex.Unlock()
 
-	if statsDebug {
-		log.Printf("Reporting %.1fm @ %.1fm/s or %.1fkm/h", latest.Meters, latest.MetersPerSecond, latest.KilometersPerHour)
+	if len(starts) == 0 {
+		// Nothing new, e.g. saved just before quitting
+		return
 	}
 
-	sm.writeLocalDB(dataPoints)
-	sm.reportStats(dataPoints)
+	var samples []FileSample
+	if sm.samples != nil {
+		samples = sm.samples.collect(cutoff, final)
+	}
+
+	sm.writeLocalDB(updated, dataPoints)
+	sm.archiveDataPoints(updated, now)
+
+	sm.report(StatsReport{
+		DataPoints:  updated,
+		Sessions:    sm.sessions.takeFinished(),
+		Samples:     samples,
+		Time:        now,
+		TotalMeters: totalMeters,
+		Today:       today,
+		TodayMeters: todayMeters,
+	})
 }
 
-func (sm *StatsMonitor) reportStats(fdps []FileDataPoint) {
-	if sm.apiBaseUrl == "" {
-		// We don't want to report to anywhere
-		return
-	}
+func (sm *StatsMonitor) updateScreen() {
+	status := sm.Status()
 
-	var adps []godometer.UpdateDataPoint
-	for _, fdp := range fdps {
-		adps = append(adps, fdp.toAPIDataPoint())
+	state := "Idle"
+	if status.Moving {
+		state = "Moving"
 	}
 
-	payload := godometer.UpdateStatsRequest{DataPoints: adps}
-	body, err := json.Marshal(payload)
-	if err != nil {
-		log.Printf("Failed to marshal request POST data: %s. Could not report stats.", err)
-		return
+	if status.Device != "" {
+		log.Printf("Input: %s", status.Device)
 	}
+	log.Printf("State: %s", state)
+	log.Printf("Total meters traveled: %.1f", status.TotalMeters)
+	log.Printf("Current m/s:  %.1f", status.MetersPerSecond)
+	log.Printf("Current km/h: %.1f", status.KilometersPerHour)
+}
 
-	url := fmt.Sprintf("%s/api/v1/updateStats", sm.apiBaseUrl)
-	request, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		log.Printf("Failed to initialize POST request: %s. Could not report stats.", err)
-		return
+func (sm *StatsMonitor) drainResults() {
+	for {
+		select {
+		case result := <-sm.results:
+			sm.update(result)
+		default:
+			return
+		}
 	}
+}
 
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", sm.apiAuth)
+func untilNextSave() time.Duration {
+	now := time.Now()
+	return now.Truncate(time.Minute).Add(time.Minute + minuteGrace).Sub(now)
+}
 
-	client := http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(request)
-	if err != nil {
-		log.Printf("API error reporting stats to %s: %s", url, err)
-		return
-	}
+// When the monitor loop last ran, for watchdogs to tell if it's stuck
+func (sm *StatsMonitor) LastAlive() time.Time {
+	sm.statsMutex.Lock()
+	defer sm.statsMutex.Unlock()
 
-	if resp.StatusCode != 200 {
-		log.Printf("API returned status %d reporting stats to %s. This is likely not a good sign.", resp.StatusCode, url)
-	}
+	return sm.lastAlive
+}
 
-	if statsDebug {
-		log.Printf("Updated %d dataPoints of data to %s", len(fdps), url)
-	}
+// Show the counters of e.g. the wheel and the pulse source in the status
+func (sm *StatsMonitor) AddCounterSource(cs CounterSource) {
+	sm.counterSources = append(sm.counterSources, cs)
 }
 
-func (sm *StatsMonitor) updateScreen() {
-	log.Printf("Total meters traveled: %.1f", sm.totalMetersTraveled)
-	log.Printf("Current m/s:  %.1f", sm.currentMPS)
-	log.Printf("Current km/h: %.1f", sm.currentKPH)
+func (sm *StatsMonitor) Counters() map[string]uint64 {
+	counters := map[string]uint64{}
+	for _, cs := range sm.counterSources {
+		for k, v := range cs.Counters() {
+			counters[k] += v
+		}
+	}
+
+	return counters
 }
 
-func (sm *StatsMonitor) Monitor(quiet bool, exit chan bool) {
-	// TODO: Save at end of each minute
-	save := time.Tick(time.Minute)
+// Process records until ctx is done, then save the current minute. Stop the pulse source
+// first so that its last records are still counted.
+func (sm *StatsMonitor) Monitor(ctx context.Context, quiet bool) {
+	// Save shortly after each minute on the clock has ended
+	save := time.After(untilNextSave())
+
+	idle := time.Tick(sm.idleAfter / 2)
+	alive := time.Tick(time.Second)
 
 	screen := make(<-chan time.Time)
 	if !quiet {
@@ -338,15 +598,29 @@ func (sm *StatsMonitor) Monitor(quiet bool, exit chan bool) {
 			// This should be synchronous
 			sm.update(result)
 
+		case <-idle:
+			sm.checkIdle()
+			sm.sessions.checkEnd()
+
 		case <-save:
-			go sm.saveStats()
+			go sm.saveStats(false)
+			save = time.After(untilNextSave())
 
 		case <-screen:
 			go sm.updateScreen()
 
-		case <-exit:
+		case <-alive:
+			sm.statsMutex.Lock()
+			sm.lastAlive = time.Now()
+			sm.statsMutex.Unlock()
+
+		case <-ctx.Done():
+			// Pulses from before the source was stopped still count
+			sm.drainResults()
+
 			// Save before quitting
-			sm.saveStats()
+			sm.sessions.Finish()
+			sm.saveStats(true)
 			return
 		}
 	}
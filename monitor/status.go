@@ -0,0 +1,225 @@
+package monitor
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Since the monitor was started
+type TripStatus struct {
+	Start             string  `json:"start"`
+	Meters            float64 `json:"m"`
+	MovingSeconds     float64 `json:"mv"`
+	KilometersPerHour float64 `json:"kph"`
+}
+
+// Live state of one input. Session is the ongoing session so far, or nil.
+// Outbox is the number of things waiting to be reported when Reporting, and
+// LastReport when any of the reporters last succeeded.
+type MonitorStatus struct {
+	Device            string            `json:"device,omitempty"`
+	Moving            bool              `json:"moving"`
+	MetersPerSecond   float64           `json:"mps"`
+	KilometersPerHour float64           `json:"kph"`
+	TotalMeters       float64           `json:"totalMeters"`
+	Trip              TripStatus        `json:"trip"`
+	Session           *FileSession      `json:"session"`
+	Reporting         bool              `json:"reporting"`
+	Outbox            int               `json:"outbox"`
+	LastReport        string            `json:"lastReport,omitempty"`
+	Reporters         []ReporterStatus  `json:"reporters"`
+	Counters          map[string]uint64 `json:"counters"`
+}
+
+type StatusResponse struct {
+	Time   string          `json:"time"`
+	Inputs []MonitorStatus `json:"inputs"`
+}
+
+func (sm *StatsMonitor) Status() MonitorStatus {
+	sm.statsMutex.Lock()
+	status := MonitorStatus{
+		Device:            sm.device,
+		Moving:            sm.moving,
+		MetersPerSecond:   sm.currentMPS,
+		KilometersPerHour: sm.currentKPH,
+		TotalMeters:       sm.totalMetersTraveled,
+		Trip: TripStatus{
+			Start:         sm.tripStart.In(utc).Format(time.RFC3339),
+			Meters:        sm.tripMeters,
+			MovingSeconds: sm.tripMovingTime.Seconds(),
+		},
+	}
+	if !sm.lastReport.IsZero() {
+		status.LastReport = sm.lastReport.In(utc).Format(time.RFC3339)
+	}
+	sm.statsMutex.Unlock()
+
+	if status.Trip.MovingSeconds > 0 {
+		status.Trip.KilometersPerHour = status.Trip.Meters / status.Trip.MovingSeconds * 3.6
+	}
+
+	status.Counters = sm.Counters()
+
+	if session, ok := sm.sessions.current(); ok {
+		status.Session = &session
+	}
+
+	status.Reporters = []ReporterStatus{}
+	for _, rs := range sm.reporters {
+		rss := rs.status()
+		status.Reporters = append(status.Reporters, rss)
+		status.Reporting = true
+		status.Outbox += rss.Waiting
+	}
+
+	return status
+}
+
+// Serves the live status of the monitors as JSON at /api/status and a small page
+// showing it at /, e.g. for a tablet next to the treadmill
+type StatusServer struct {
+	addr          string
+	monitors      []*StatsMonitor
+	monitorsMutex *sync.Mutex
+}
+
+func NewStatusServer(addr string) *StatusServer {
+	ss := &StatusServer{}
+	ss.addr = addr
+	ss.monitors = []*StatsMonitor{}
+	ss.monitorsMutex = &sync.Mutex{}
+
+	return ss
+}
+
+func (ss *StatusServer) Add(sm *StatsMonitor) {
+	ss.monitorsMutex.Lock()
+	defer ss.monitorsMutex.Unlock()
+
+	ss.monitors = append(ss.monitors, sm)
+}
+
+func (ss *StatusServer) Start() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/status", ss.returnStatus)
+	mux.HandleFunc("/", ss.returnPage)
+
+	go func() {
+		log.Printf("Serving status at http://%s/", ss.addr)
+		err := http.ListenAndServe(ss.addr, mux)
+		if err != nil {
+			log.Printf("Status server stopped: %s", err)
+		}
+	}()
+}
+
+func (ss *StatusServer) returnStatus(w http.ResponseWriter, r *http.Request) {
+	ss.monitorsMutex.Lock()
+	monitors := ss.monitors
+	ss.monitorsMutex.Unlock()
+
+	resp := StatusResponse{
+		Time:   time.Now().In(utc).Format(time.RFC3339),
+		Inputs: []MonitorStatus{},
+	}
+	for _, sm := range monitors {
+		resp.Inputs = append(resp.Inputs, sm.Status())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("Could not write status response: %s", err)
+	}
+}
+
+func (ss *StatusServer) returnPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(statusPage))
+}
+
+const statusPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Godometer</title>
+<style>
+body { background: #111; color: #eee; font-family: sans-serif; margin: 0; padding: 1em; }
+.input { margin-bottom: 2em; }
+.name { color: #888; font-size: 1.5em; }
+.speed { font-size: 8em; font-weight: bold; line-height: 1; }
+.speed small { font-size: 0.3em; color: #888; }
+.idle .speed { color: #555; }
+table { font-size: 1.5em; border-spacing: 1em 0.2em; margin-left: -1em; }
+td:first-child { color: #888; }
+#error { color: #e55; }
+</style>
+</head>
+<body>
+<div id="inputs"></div>
+<div id="error"></div>
+<script>
+function km(m) { return (m / 1000).toFixed(2) + " km" }
+function hms(s) {
+  s = Math.floor(s)
+  var m = Math.floor(s / 60) % 60, h = Math.floor(s / 3600)
+  return h + ":" + ("0" + m).slice(-2) + ":" + ("0" + s % 60).slice(-2)
+}
+function ago(ts) {
+  if (!ts) return "never"
+  return hms((Date.now() - Date.parse(ts)) / 1000) + " ago"
+}
+function esc(s) {
+  return s.replace(/[&<>"]/g, function (c) { return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;"}[c] })
+}
+function row(label, value) { return "<tr><td>" + label + "</td><td>" + value + "</td></tr>" }
+function render(status) {
+  var html = ""
+  status.inputs.forEach(function (i) {
+    html += '<div class="input ' + (i.moving ? "moving" : "idle") + '">'
+    if (i.device) html += '<div class="name">' + esc(i.device) + "</div>"
+    html += '<div class="speed">' + i.kph.toFixed(1) + " <small>km/h</small></div><table>"
+    if (i.session) {
+      html += row("Session", km(i.session.m) + " in " + hms(i.session.mv) + ", " + i.session.kph.toFixed(1) + " km/h")
+    } else {
+      html += row("Session", "none")
+    }
+    html += row("Trip", km(i.trip.m) + " in " + hms(i.trip.mv) + ", " + i.trip.kph.toFixed(1) + " km/h")
+    html += row("Total", km(i.totalMeters))
+    if (i.counters.dropped || i.counters.lineErrors) {
+      html += row("Problems", (i.counters.dropped || 0) + " records dropped, " + (i.counters.lineErrors || 0) + " GPIO errors")
+    }
+    if (i.reporting) {
+      html += row("Waiting", i.outbox + " to report, last report " + ago(i.lastReport))
+      i.reporters.forEach(function (r) {
+        if (r.lastError) html += row(esc(r.name), "failing: " + esc(r.lastError))
+      })
+    }
+    html += "</table></div>"
+  })
+  document.getElementById("inputs").innerHTML = html
+}
+function poll() {
+  fetch("api/status").then(function (r) { return r.json() }).then(function (status) {
+    document.getElementById("error").textContent = ""
+    render(status)
+  }).catch(function (e) {
+    document.getElementById("error").textContent = "Monitor not reachable: " + e
+  })
+}
+poll()
+setInterval(poll, 1000)
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,85 @@
+package monitor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// What is POSTed to a webhook, in the same format as the local files
+type WebhookPayload struct {
+	Device     string          `json:"device,omitempty"`
+	DataPoints []FileDataPoint `json:"dataPoints"`
+	Sessions   []FileSession   `json:"sessions"`
+	Samples    []FileSample    `json:"samples"`
+}
+
+// Sends batches as JSON to any URL, a 2xx response means everything was handled.
+// Data points that were updated are sent again with the same timestamp.
+type WebhookSender struct {
+	url    string
+	auth   string
+	client http.Client
+}
+
+func NewWebhookSender(url string, auth string) *WebhookSender {
+	ws := &WebhookSender{}
+	ws.url = url
+	ws.auth = auth
+	ws.client = http.Client{Timeout: 10 * time.Second}
+
+	return ws
+}
+
+// Reports to a webhook through its own outbox next to the local DB
+func NewWebhookReporter(dbPath string, url string, auth string) *OutboxReporter {
+	return NewOutboxReporter(siblingPath(dbPath, "webhook-outbox"), NewWebhookSender(url, auth))
+}
+
+func (ws *WebhookSender) Name() string {
+	return "webhook " + ws.url
+}
+
+func (ws *WebhookSender) Send(device string, batch OutboxBatch) (OutboxBatch, error) {
+	payload := WebhookPayload{
+		Device:     device,
+		DataPoints: append([]FileDataPoint{}, batch.DataPoints...),
+		Sessions:   append([]FileSession{}, batch.Sessions...),
+		Samples:    append([]FileSample{}, batch.Samples...),
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxBatch{}, fmt.Errorf("failed to marshal webhook payload: %s", err)
+	}
+
+	request, err := http.NewRequest("POST", ws.url, bytes.NewBuffer(body))
+	if err != nil {
+		return OutboxBatch{}, fmt.Errorf("failed to initialize POST request: %s", err)
+	}
+
+	request.Header.Set("Content-Type", "application/json")
+	if ws.auth != "" {
+		request.Header.Set("Authorization", ws.auth)
+	}
+
+	resp, err := ws.client.Do(request)
+	if err != nil {
+		return OutboxBatch{}, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return OutboxBatch{}, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,238 @@
+package monitor
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// What the wheel decided to do with a pulse
+type PulseStatus string
+
+const (
+	PulseAccepted    PulseStatus = "ok"
+	PulseTooFast     PulseStatus = "too-fast"
+	PulseTooSlow     PulseStatus = "too-slow" // Also the very first pulse
+	PulseSameEdge    PulseStatus = "same-edge"
+	PulseImplausible PulseStatus = "implausible" // Speeding up faster than possible
+	PulseBackward    PulseStatus = "backward"    // Wheel rotating backwards and those are ignored
+	PulseQuadrant    PulseStatus = "direction"   // Only used for tracking direction
+)
+
+type Direction int
+
+const (
+	Forward Direction = iota
+	Backward
+)
+
+func (d Direction) String() string {
+	if d == Backward {
+		return "backward"
+	}
+	return "forward"
+}
+
+// Gets notified of every pulse the wheel sees, accepted or not
+type PulseObserver func(p Pulse, status PulseStatus)
+
+// Meters is negative when moving backwards, speeds are always positive
+type GPIORecord struct {
+	Time              time.Time
+	Meters            float64
+	MetersPerSecond   float64
+	KilometersPerHour float64
+	Direction         Direction
+}
+
+// Turns raw pulses from any PulseSource in to distance and speed records
+type Wheel struct {
+	wheelCircumferenceMeters float64
+	pulsesPerRevolution      int
+	metersPerPulse           float64
+	filter                   GlitchFilter
+	minElapsed               time.Duration
+	maxElapsed               time.Duration
+	lastRead                 time.Time
+	lastRising               time.Time
+	lastMPS                  float64
+	lastValue                Edge
+	detectDirection          bool
+	subtractBackward         bool
+	directionHigh            bool
+	handlerMutex             *sync.Mutex
+	results                  chan GPIORecord
+	observers                []PulseObserver
+	pulses                   uint64
+	records                  uint64
+	dropped                  uint64
+	lastDropLog              time.Time
+}
+
+// Every pulsesPerRevolution rising edges is one full revolution of the wheel, e.g. when
+// multiple magnets are attached to it
+func NewWheel(wheelCircumferenceMeters float64, pulsesPerRevolution int, filter GlitchFilter, results chan GPIORecord) *Wheel {
+	if pulsesPerRevolution < 1 {
+		pulsesPerRevolution = 1
+	}
+
+	w := &Wheel{}
+	w.wheelCircumferenceMeters = wheelCircumferenceMeters
+	w.pulsesPerRevolution = pulsesPerRevolution
+	w.metersPerPulse = wheelCircumferenceMeters / float64(pulsesPerRevolution)
+	w.filter = filter
+	w.minElapsed, w.maxElapsed = filter.limits(w.metersPerPulse)
+	w.lastValue = FallingEdge
+	w.results = results
+	w.handlerMutex = &sync.Mutex{}
+
+	return w
+}
+
+// How long without pulses until the wheel should be considered stopped
+func (w *Wheel) IdleTimeout() time.Duration {
+	return w.maxElapsed
+}
+
+func metersPerSecond(elapsed time.Duration, meters float64) float64 {
+	elapsedMillis := float64(elapsed) / float64(time.Millisecond)
+	toSeconds := 1000.0 / elapsedMillis
+
+	return toSeconds * meters
+}
+
+// Use pulses from the DirectionChannel to tell which way the wheel is rotating. The
+// sensors are expected to be in quadrature, i.e. their active periods overlap, and
+// the direction sensor is active when the primary one activates only when going
+// backwards. Backward movement is either ignored or subtracted from the distance.
+func (w *Wheel) DetectDirection(subtractBackward bool) {
+	w.handlerMutex.Lock()
+	defer w.handlerMutex.Unlock()
+
+	w.detectDirection = true
+	w.subtractBackward = subtractBackward
+}
+
+func (w *Wheel) AddObserver(observer PulseObserver) {
+	w.handlerMutex.Lock()
+	defer w.handlerMutex.Unlock()
+
+	w.observers = append(w.observers, observer)
+}
+
+// How many pulses the wheel has seen, and how many records it has produced and had to drop
+// because nothing was reading them
+func (w *Wheel) Counters() map[string]uint64 {
+	w.handlerMutex.Lock()
+	defer w.handlerMutex.Unlock()
+
+	return map[string]uint64{
+		"pulses":  w.pulses,
+		"records": w.records,
+		"dropped": w.dropped,
+	}
+}
+
+func (w *Wheel) Handle(p Pulse) {
+	w.handlerMutex.Lock()
+	defer w.handlerMutex.Unlock()
+
+	w.pulses++
+	status := w.handle(p)
+	for _, observer := range w.observers {
+		observer(p, status)
+	}
+}
+
+func (w *Wheel) handle(p Pulse) PulseStatus {
+	if p.Channel == DirectionChannel {
+		w.directionHigh = p.Edge == RisingEdge
+		return PulseQuadrant
+	}
+
+	now := p.Time
+	elapsed := now.Sub(w.lastRead)
+	value := p.Edge
+
+	if w.lastRead.IsZero() || elapsed > w.maxElapsed {
+		// Reset counting whenever we've been paused for a little while
+		w.lastRead = now
+		w.lastValue = value
+		w.lastMPS = 0
+		w.lastRising = time.Time{}
+		if value == RisingEdge {
+			w.lastRising = now
+		}
+		return PulseTooSlow
+	} else {
+		// Too fast updates - some sort of flapping likely going on
+		if elapsed < w.minElapsed {
+			return PulseTooFast
+		}
+	}
+
+	// Same values being sent repeatedly - junk data
+	if value == w.lastValue {
+		return PulseSameEdge
+	}
+
+	if value != RisingEdge {
+		w.lastRead = now
+		w.lastValue = value
+		return PulseAccepted
+	}
+
+	// Measure from the previous pulse when we have one, otherwise the best
+	// guess is the time since the sensor was released
+	pulseElapsed := elapsed
+	if !w.lastRising.IsZero() {
+		pulseElapsed = now.Sub(w.lastRising)
+	}
+
+	mps := metersPerSecond(pulseElapsed, w.metersPerPulse)
+	if !w.filter.plausible(w.lastMPS, mps, pulseElapsed) {
+		// Most likely an extra pulse from noise, the next real one will be measured
+		// from the last one we believed in
+		return PulseImplausible
+	}
+
+	// Also when the pulse turns out to be an ignored backward one, the next edges are
+	// measured from it
+	w.lastRead = now
+	w.lastValue = value
+	w.lastRising = now
+	w.lastMPS = mps
+
+	kph := mps * 3600.0 / 1000.0 // 3600s/h & 1000m/km
+
+	result := GPIORecord{
+		Time:              now,
+		Meters:            w.metersPerPulse,
+		MetersPerSecond:   mps,
+		KilometersPerHour: kph,
+		Direction:         Forward,
+	}
+
+	if w.detectDirection && w.directionHigh {
+		if !w.subtractBackward {
+			return PulseBackward
+		}
+
+		result.Meters = -result.Meters
+		result.Direction = Backward
+	}
+
+	// Never block the pulse source, losing a record is better than missing the pulses after it
+	select {
+	case w.results <- result:
+		w.records++
+	default:
+		w.dropped++
+		if time.Since(w.lastDropLog) > time.Minute {
+			log.Printf("Results buffer is full, something is very wrong! %d records dropped so far.", w.dropped)
+			w.lastDropLog = time.Now()
+		}
+	}
+
+	return PulseAccepted
+}
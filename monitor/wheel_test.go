@@ -0,0 +1,116 @@
+package monitor
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func newTestWheel() (*Wheel, chan GPIORecord) {
+	results := make(chan GPIORecord, 10)
+	return NewWheel(0.2375, 1, DefaultGlitchFilter(), results), results
+}
+
+type testPulse struct {
+	at      time.Duration
+	edge    Edge
+	channel int
+	status  PulseStatus
+}
+
+func handleAll(t *testing.T, w *Wheel, pulses []testPulse) {
+	t.Helper()
+
+	start := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	for i, tp := range pulses {
+		status := w.handle(Pulse{Time: start.Add(tp.at), Edge: tp.edge, Channel: tp.channel})
+		if status != tp.status {
+			t.Fatalf("pulse %d: expected %s, got %s", i, tp.status, status)
+		}
+	}
+}
+
+func TestWheelForward(t *testing.T) {
+	w, results := newTestWheel()
+	handleAll(t, w, []testPulse{
+		{0, RisingEdge, PrimaryChannel, PulseTooSlow},
+		{10 * time.Millisecond, FallingEdge, PrimaryChannel, PulseTooFast},
+		{100 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{150 * time.Millisecond, FallingEdge, PrimaryChannel, PulseSameEdge},
+		{200 * time.Millisecond, RisingEdge, PrimaryChannel, PulseAccepted},
+		{5 * time.Second, FallingEdge, PrimaryChannel, PulseTooSlow},
+	})
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(results))
+	}
+
+	record := <-results
+	if record.Meters != 0.2375 || record.Direction != Forward {
+		t.Errorf("expected 0.2375m forward, got %vm %s", record.Meters, record.Direction)
+	}
+	if math.Abs(record.MetersPerSecond-1.1875) > 0.0001 {
+		t.Errorf("expected 1.1875m/s, got %v", record.MetersPerSecond)
+	}
+}
+
+func TestWheelImplausible(t *testing.T) {
+	w, results := newTestWheel()
+	handleAll(t, w, []testPulse{
+		{0, RisingEdge, PrimaryChannel, PulseTooSlow},
+		{500 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{1000 * time.Millisecond, RisingEdge, PrimaryChannel, PulseAccepted},
+		// Ten times the speed within 100ms
+		{1050 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{1100 * time.Millisecond, RisingEdge, PrimaryChannel, PulseImplausible},
+	})
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(results))
+	}
+}
+
+func TestWheelIgnoreBackward(t *testing.T) {
+	w, results := newTestWheel()
+	w.DetectDirection(false)
+	handleAll(t, w, []testPulse{
+		{0, RisingEdge, PrimaryChannel, PulseTooSlow},
+		{100 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{150 * time.Millisecond, RisingEdge, DirectionChannel, PulseQuadrant},
+		{200 * time.Millisecond, RisingEdge, PrimaryChannel, PulseBackward},
+		{250 * time.Millisecond, FallingEdge, DirectionChannel, PulseQuadrant},
+		// Would be the same edge again if the backward pulse wasn't remembered
+		{300 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{400 * time.Millisecond, RisingEdge, PrimaryChannel, PulseAccepted},
+	})
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(results))
+	}
+
+	// Measured from the backward pulse, not the one before it
+	record := <-results
+	if record.Direction != Forward || math.Abs(record.MetersPerSecond-1.1875) > 0.0001 {
+		t.Errorf("expected 1.1875m/s forward, got %vm/s %s", record.MetersPerSecond, record.Direction)
+	}
+}
+
+func TestWheelSubtractBackward(t *testing.T) {
+	w, results := newTestWheel()
+	w.DetectDirection(true)
+	handleAll(t, w, []testPulse{
+		{0, RisingEdge, PrimaryChannel, PulseTooSlow},
+		{100 * time.Millisecond, FallingEdge, PrimaryChannel, PulseAccepted},
+		{150 * time.Millisecond, RisingEdge, DirectionChannel, PulseQuadrant},
+		{200 * time.Millisecond, RisingEdge, PrimaryChannel, PulseAccepted},
+	})
+
+	if len(results) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(results))
+	}
+
+	record := <-results
+	if record.Meters != -0.2375 || record.Direction != Backward || record.MetersPerSecond <= 0 {
+		t.Errorf("expected -0.2375m backward at a positive speed, got %vm %s at %vm/s", record.Meters, record.Direction, record.MetersPerSecond)
+	}
+}
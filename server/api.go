@@ -8,6 +8,7 @@ import (
 	"math"
 	"net/http"
 	"path/filepath"
+	"sync"
 	"time"
 
 	stackdriver "github.com/tommy351/zap-stackdriver"
@@ -39,12 +40,23 @@ const (
 	yearLayout   = "2006"
 )
 
-// Timestamp is key, need counter for updating averages
+// Timestamp is key, need counter for updating averages. Minutes also have what each
+// device reported for them, to recognise data points that are sent again or updated.
 type DBDataPoint struct {
-	Counter           int64   `json:"c",firestore:"counter"`
-	Meters            float32 `json:"m",firestore:"meters"`
-	MetersPerSecond   float32 `json:"mps",firestore:"mps"`
-	KilometersPerHour float32 `json:"kph",firestore:"kph"`
+	Counter           int64             `json:"c" firestore:"Counter"`
+	Meters            float32           `json:"m" firestore:"Meters"`
+	MetersPerSecond   float32           `json:"mps" firestore:"MetersPerSecond"`
+	KilometersPerHour float32           `json:"kph" firestore:"KilometersPerHour"`
+	Devices           []DeviceDataPoint `json:"-" firestore:"Devices,omitempty"`
+}
+
+// What one device reported for a minute, replaced when the device sends the minute again
+// with more pulses in it
+type DeviceDataPoint struct {
+	Device            string  `firestore:"Device"`
+	Meters            float32 `firestore:"Meters"`
+	MetersPerSecond   float32 `firestore:"MetersPerSecond"`
+	KilometersPerHour float32 `firestore:"KilometersPerHour"`
 }
 
 func (ddp *DBDataPoint) toResponseDataPoint(ts string) ResponseDataPoint {
@@ -58,6 +70,7 @@ func (ddp *DBDataPoint) toResponseDataPoint(ts string) ResponseDataPoint {
 }
 
 type ResponseDataPoint struct {
+	Device            string  `json:"device,omitempty"`
 	Counter           int64   `json:"c"`
 	Timestamp         string  `json:"ts"`
 	Meters            float32 `json:"m"`
@@ -65,6 +78,29 @@ type ResponseDataPoint struct {
 	KilometersPerHour float32 `json:"kph"`
 }
 
+// Device and Start are the key, a session is reported again until it drops out of the device's history
+type ResponseSession struct {
+	Device               string  `json:"device,omitempty" firestore:"Device"`
+	Start                string  `json:"start" firestore:"Start"`
+	End                  string  `json:"end" firestore:"End"`
+	MovingSeconds        float32 `json:"mv" firestore:"MovingSeconds"`
+	Meters               float32 `json:"m" firestore:"Meters"`
+	MetersPerSecond      float32 `json:"mps" firestore:"MetersPerSecond"`
+	KilometersPerHour    float32 `json:"kph" firestore:"KilometersPerHour"`
+	MaxMetersPerSecond   float32 `json:"maxMps" firestore:"MaxMetersPerSecond"`
+	MaxKilometersPerHour float32 `json:"maxKph" firestore:"MaxKilometersPerHour"`
+}
+
+// Samples finer than a minute, Device and Timestamp are the key
+type ResponseSample struct {
+	Device            string  `json:"device,omitempty" firestore:"Device"`
+	Timestamp         string  `json:"ts" firestore:"Timestamp"`
+	Seconds           int     `json:"s" firestore:"Seconds"`
+	Meters            float32 `json:"m" firestore:"Meters"`
+	MetersPerSecond   float32 `json:"mps" firestore:"MetersPerSecond"`
+	KilometersPerHour float32 `json:"kph" firestore:"KilometersPerHour"`
+}
+
 type EventsResponse struct {
 	Events []ResponseDataPoint `json:"events"`
 }
@@ -74,16 +110,29 @@ type StatsResponse struct {
 	DataPoints      []ResponseDataPoint `json:"dataPoints"`
 }
 
+type SamplesResponse struct {
+	Samples []ResponseSample `json:"samples"`
+}
+
+type SessionsResponse struct {
+	Sessions []ResponseSession `json:"sessions"`
+}
+
 type Server struct {
-	projectId  string
-	lastEvents []ResponseDataPoint
-	minutes    map[string]DBDataPoint
-	hours      map[string]DBDataPoint
-	days       map[string]DBDataPoint
-	weeks      map[string]DBDataPoint
-	months     map[string]DBDataPoint
-	years      map[string]DBDataPoint
-	engine     *gin.Engine
+	projectId    string
+	lastEvents   []ResponseDataPoint
+	lastSessions []ResponseSession
+	minutes      map[string]DBDataPoint
+	hours        map[string]DBDataPoint
+	days         map[string]DBDataPoint
+	weeks        map[string]DBDataPoint
+	months       map[string]DBDataPoint
+	years        map[string]DBDataPoint
+	samples      map[string]SampleContainer
+	// Updates hold it and everything returning records holds it for reading, as the maps
+	// must not be read while they are written
+	recordsMutex *sync.RWMutex
+	engine       *gin.Engine
 }
 
 func getLogger() *zap.Logger {
@@ -126,8 +175,28 @@ func (s *Server) updateStats(c *gin.Context) {
 		return
 	}
 
+	s.recordsMutex.Lock()
+	defer s.recordsMutex.Unlock()
+
 	ctx := context.Background()
-	s.writeStats(ctx, req.DataPoints)
+	resp := godometer.UpdateStatsResponse{}
+
+	// Each part is saved on its own. If one fails the monitor sends everything again, and
+	// the parts that were already saved are recognised as duplicates.
+	resp.DataPoints, err = s.writeStats(ctx, req.Device, req.DataPoints)
+	if err == nil {
+		resp.Sessions, err = s.writeSessions(ctx, req.Device, req.Sessions)
+	}
+	if err == nil {
+		resp.Samples, err = s.writeSamples(ctx, req.Device, req.Samples)
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, godometer.UpdateStatsResponse{Error: err.Error()})
+		return
+	}
+
+	c.JSON(200, resp)
 }
 
 func getPeriodIds(period string) []string {
@@ -155,13 +224,65 @@ func getPeriodIds(period string) []string {
 }
 
 func (s *Server) returnEvents(c *gin.Context) {
+	s.recordsMutex.RLock()
+	defer s.recordsMutex.RUnlock()
+
 	c.JSON(200, EventsResponse{
 		Events: s.lastEvents,
 	})
 }
 
+func (s *Server) returnSessions(c *gin.Context) {
+	s.recordsMutex.RLock()
+	defer s.recordsMutex.RUnlock()
+
+	c.JSON(200, SessionsResponse{
+		Sessions: s.lastSessions,
+	})
+}
+
+// Samples between from and to (RFC3339, default the last hour), optionally only for one device
+func (s *Server) returnSamples(c *gin.Context) {
+	to := time.Now().In(utc)
+	from := to.Add(-time.Hour)
+
+	if e := c.Query("to"); e != "" {
+		t, err := time.Parse(time.RFC3339, e)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		to = t
+	}
+
+	if e := c.Query("from"); e != "" {
+		t, err := time.Parse(time.RFC3339, e)
+		if err != nil {
+			_ = c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		from = t
+	}
+
+	if to.Before(from) || to.Sub(from) > maxSampleRange {
+		_ = c.AbortWithError(http.StatusBadRequest, fmt.Errorf("invalid sample range %s - %s", from, to))
+		return
+	}
+
+	s.recordsMutex.RLock()
+	samples := s.readSamples(context.Background(), from, to, c.Query("device"))
+	s.recordsMutex.RUnlock()
+
+	c.JSON(200, SamplesResponse{
+		Samples: samples,
+	})
+}
+
 func (s *Server) returnRecords(period string) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		s.recordsMutex.RLock()
+		defer s.recordsMutex.RUnlock()
+
 		var availableDataPoints map[string]DBDataPoint
 		if period == "years" {
 			availableDataPoints = s.years
@@ -241,7 +362,7 @@ func (s *Server) Run(listenAddr string, fakeData bool) {
 
 	err := s.engine.Run(listenAddr)
 	if err != nil {
-		log.Panic("Failed to run server: %s", err)
+		log.Panicf("Failed to run server: %s", err)
 	}
 }
 
@@ -264,11 +385,14 @@ func NewServer(dev bool, projectId string, apiAuth string) *Server {
 
 	srv := &Server{}
 	srv.projectId = projectId
+	srv.recordsMutex = &sync.RWMutex{}
 	srv.loadData()
 
 	apiV1 := router.Group("/api/v1")
 	apiV1.POST("/updateStats", AuthRequired(apiAuth), srv.updateStats)
 	apiV1.GET("/stats/events", srv.returnEvents)
+	apiV1.GET("/stats/sessions", srv.returnSessions)
+	apiV1.GET("/stats/samples", srv.returnSamples)
 	apiV1.GET("/stats/minutes", srv.returnRecords("minutes"))
 	apiV1.GET("/stats/hours", srv.returnRecords("hours"))
 	apiV1.GET("/stats/days", srv.returnRecords("days"))
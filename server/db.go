@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
 	"sort"
 	"time"
@@ -16,12 +17,34 @@ import (
 
 const debugDb = false
 
+// How many of the latest workout sessions to keep around for the API
+const keepLastSessions = 20
+
+// Longest range of samples to return at once
+const maxSampleRange = 6 * time.Hour
+
 var utc, _ = time.LoadLocation("UTC")
 
 type LastEventContainer struct {
 	Events []ResponseDataPoint `firestore:"events"`
 }
 
+type LastSessionContainer struct {
+	Sessions []ResponseSession `firestore:"sessions"`
+}
+
+// Samples of one minute, keyed by device and timestamp
+type SampleContainer struct {
+	Samples map[string]ResponseSample `firestore:"samples"`
+}
+
+func sampleKey(device string, timestamp string) string {
+	if device == "" {
+		return timestamp
+	}
+	return device + " " + timestamp
+}
+
 func collectionName(period string) string {
 	return fmt.Sprintf("godometer-%s-records", period)
 }
@@ -150,6 +173,8 @@ func (s *Server) loadData() {
 
 	ctx := context.Background()
 	s.readEvents(ctx)
+	s.readSessions(ctx)
+	s.samples = s.readSampleContainers(ctx, minutes[:])
 	s.readYears(ctx, years[:])
 	s.readMonths(ctx, months[:])
 	s.readWeeks(ctx, weeks[:])
@@ -187,6 +212,104 @@ func (s *Server) readEvents(ctx context.Context) {
 	}
 }
 
+func (s *Server) readSessions(ctx context.Context) {
+	s.lastSessions = []ResponseSession{}
+
+	db := GetClient(ctx, s.projectId)
+	sessionsColl := db.Collection(collectionName("sessions"))
+	ref := sessionsColl.Doc("lastSessions")
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		logger.Warn("Got error trying to load past sessions", zap.Error(err))
+		return
+	}
+
+	sessionContainer := LastSessionContainer{}
+	err = doc.DataTo(&sessionContainer)
+	if err != nil {
+		logger.Warn("Got error trying to parse past sessions", zap.Error(err))
+		return
+	}
+
+	s.lastSessions = sessionContainer.Sessions
+}
+
+func (s *Server) readSampleContainers(ctx context.Context, minutes []string) map[string]SampleContainer {
+	containers := map[string]SampleContainer{}
+	if len(minutes) == 0 {
+		return containers
+	}
+
+	db := GetClient(ctx, s.projectId)
+	collRef := db.Collection(collectionName("samples"))
+	var refs []*firestore.DocumentRef
+	for _, id := range minutes {
+		refs = append(refs, collRef.Doc(id))
+	}
+
+	results, err := db.GetAll(ctx, refs)
+	if err != nil {
+		logger.Warn("Error fetching samples from DB", zap.Error(err))
+	}
+
+	for _, r := range results {
+		container := SampleContainer{Samples: map[string]ResponseSample{}}
+
+		// Minutes without samples are fine
+		if r.Exists() {
+			err := r.DataTo(&container)
+			if err != nil {
+				logger.Warn("Failed to read samples from DB", zap.Error(err))
+			}
+		}
+		containers[r.Ref.ID] = container
+	}
+
+	return containers
+}
+
+// The last hour is in memory, older samples are read from the DB
+func (s *Server) readSamples(ctx context.Context, from time.Time, to time.Time, device string) []ResponseSample {
+	var containers []SampleContainer
+	var missing []string
+	for current := from.In(utc).Truncate(time.Minute); !current.After(to); current = current.Add(time.Minute) {
+		minute := current.Format(minuteLayout)
+		if container, ok := s.samples[minute]; ok {
+			containers = append(containers, container)
+		} else {
+			missing = append(missing, minute)
+		}
+	}
+
+	for _, container := range s.readSampleContainers(ctx, missing) {
+		containers = append(containers, container)
+	}
+
+	fromStr := from.In(utc).Format(godometer.APISampleTimeLayout)
+	toStr := to.In(utc).Format(godometer.APISampleTimeLayout)
+	samples := []ResponseSample{}
+	for _, container := range containers {
+		for _, sample := range container.Samples {
+			if device != "" && sample.Device != device {
+				continue
+			}
+			if sample.Timestamp < fromStr || sample.Timestamp > toStr {
+				continue
+			}
+			samples = append(samples, sample)
+		}
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Timestamp == samples[j].Timestamp {
+			return samples[i].Device < samples[j].Device
+		}
+		return samples[i].Timestamp < samples[j].Timestamp
+	})
+
+	return samples
+}
+
 func (s *Server) readRecords(ctx context.Context, collection string, ids []string) map[string]DBDataPoint {
 	db := GetClient(ctx, s.projectId)
 	collRef := db.Collection(collection)
@@ -367,6 +490,12 @@ func (s *Server) clearOldStats() {
 			delete(s.years, key)
 		}
 	}
+
+	for key := range s.samples {
+		if !stringInList(minutes[:], key) {
+			delete(s.samples, key)
+		}
+	}
 }
 
 func calculateUpdate(old DBDataPoint, ok bool, newRow DBDataPoint) (DBDataPoint, bool) {
@@ -400,41 +529,279 @@ func calculateUpdate(old DBDataPoint, ok bool, newRow DBDataPoint) (DBDataPoint,
 	return result, save
 }
 
-func (s *Server) isKnownEvent(dataPoint godometer.UpdateDataPoint) bool {
-	for _, dp := range s.lastEvents {
-		if dp.Timestamp == dataPoint.Timestamp {
-			return true
+// Undo adding old to row with calculateUpdate
+func removeUpdate(row DBDataPoint, old DBDataPoint) DBDataPoint {
+	result := row
+	result.Meters = row.Meters - old.Meters
+	// Rounding must not leave negative distances around
+	if result.Meters < 0 {
+		result.Meters = 0
+	}
+
+	if old.Meters > 0 && old.MetersPerSecond > 0 && old.KilometersPerHour > 0 && row.Counter > 0 {
+		totalMPS := (row.MetersPerSecond * float32(row.Counter)) - old.MetersPerSecond
+		totalKPH := (row.KilometersPerHour * float32(row.Counter)) - old.KilometersPerHour
+
+		result.Counter = row.Counter - 1
+		if result.Counter > 0 {
+			result.MetersPerSecond = totalMPS / float32(result.Counter)
+			result.KilometersPerHour = totalKPH / float32(result.Counter)
+		} else {
+			result.MetersPerSecond = 0
+			result.KilometersPerHour = 0
 		}
 	}
 
-	return false
+	return result
+}
+
+// What the device already reported for the minute, from the minute itself or for minutes
+// saved before those were stored, from the latest events
+func (s *Server) reportedDataPoint(device string, timestamp string) (DBDataPoint, bool) {
+	for _, ddp := range s.minutes[timestamp].Devices {
+		if ddp.Device == device {
+			return DBDataPoint{
+				Counter:           1,
+				Meters:            ddp.Meters,
+				MetersPerSecond:   ddp.MetersPerSecond,
+				KilometersPerHour: ddp.KilometersPerHour,
+			}, true
+		}
+	}
+
+	for i := len(s.lastEvents) - 1; i >= 0; i-- {
+		if e := s.lastEvents[i]; e.Device == device && e.Timestamp == timestamp {
+			return DBDataPoint{
+				Counter:           1,
+				Meters:            e.Meters,
+				MetersPerSecond:   e.MetersPerSecond,
+				KilometersPerHour: e.KilometersPerHour,
+			}, true
+		}
+	}
+
+	return DBDataPoint{}, false
+}
+
+// Replace what device reported in a minute
+func setDeviceDataPoint(devices []DeviceDataPoint, device string, dataPoint DBDataPoint) []DeviceDataPoint {
+	ddp := DeviceDataPoint{
+		Device:            device,
+		Meters:            dataPoint.Meters,
+		MetersPerSecond:   dataPoint.MetersPerSecond,
+		KilometersPerHour: dataPoint.KilometersPerHour,
+	}
+
+	result := []DeviceDataPoint{}
+	for _, d := range devices {
+		if d.Device != device {
+			result = append(result, d)
+		}
+	}
+
+	return append(result, ddp)
+}
+
+// Add an event, dropping an earlier one of the same device and minute
+func (s *Server) replaceLastEvent(event ResponseDataPoint) {
+	events := []ResponseDataPoint{}
+	for _, e := range s.lastEvents {
+		if e.Device != event.Device || e.Timestamp != event.Timestamp {
+			events = append(events, e)
+		}
+	}
+
+	s.lastEvents = append(events, event)
 }
 
+// Keep the latest events of each device, they all resend their own
 func (s *Server) cleanLastEvents() {
 	max := 5
-	current := len(s.lastEvents)
-	keep := 0
-
-	if current > max {
-		keep = current - max
+	counts := map[string]int{}
+	events := []ResponseDataPoint{}
+
+	for i := len(s.lastEvents) - 1; i >= 0; i-- {
+		event := s.lastEvents[i]
+		counts[event.Device] += 1
+		if counts[event.Device] <= max {
+			events = append([]ResponseDataPoint{event}, events...)
+		}
 	}
 
-	s.lastEvents = s.lastEvents[keep:]
+	s.lastEvents = events
 }
 
-func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.UpdateDataPoint) {
+// Old data points, e.g. from a monitor that was offline for a while, need their periods
+// from the DB to add to
+func (s *Server) readMissingRecords(ctx context.Context, updateDataPoints []godometer.UpdateDataPoint) {
 	var years []string
 	var months []string
 	var weeks []string
 	var days []string
 	var hours []string
 	var minutes []string
-	var newEvents []string
 
-	newDataPoints := 0
 	for _, udp := range updateDataPoints {
-		// Ignore already processed events
-		if s.isKnownEvent(udp) {
+		ts, err := time.Parse(minuteLayout, udp.Timestamp)
+		if err != nil {
+			continue
+		}
+
+		if key := ts.Format(yearLayout); !stringInList(years, key) {
+			if _, ok := s.years[key]; !ok {
+				years = append(years, key)
+			}
+		}
+
+		if key := ts.Format(monthLayout); !stringInList(months, key) {
+			if _, ok := s.months[key]; !ok {
+				months = append(months, key)
+			}
+		}
+
+		if key := weekFormat(ts); !stringInList(weeks, key) {
+			if _, ok := s.weeks[key]; !ok {
+				weeks = append(weeks, key)
+			}
+		}
+
+		if key := ts.Format(dayLayout); !stringInList(days, key) {
+			if _, ok := s.days[key]; !ok {
+				days = append(days, key)
+			}
+		}
+
+		if key := ts.Format(hourLayout); !stringInList(hours, key) {
+			if _, ok := s.hours[key]; !ok {
+				hours = append(hours, key)
+			}
+		}
+
+		if key := ts.Format(minuteLayout); !stringInList(minutes, key) {
+			if _, ok := s.minutes[key]; !ok {
+				minutes = append(minutes, key)
+			}
+		}
+	}
+
+	if len(years) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("years"), years) {
+			s.years[key] = row
+		}
+	}
+
+	if len(months) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("months"), months) {
+			s.months[key] = row
+		}
+	}
+
+	if len(weeks) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("weeks"), weeks) {
+			s.weeks[key] = row
+		}
+	}
+
+	if len(days) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("days"), days) {
+			s.days[key] = row
+		}
+	}
+
+	if len(hours) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("hours"), hours) {
+			s.hours[key] = row
+		}
+	}
+
+	if len(minutes) > 0 {
+		for key, row := range s.readRecords(ctx, collectionName("minutes"), minutes) {
+			s.minutes[key] = row
+		}
+	}
+}
+
+// Copy of the records in memory, to undo changes that could not be saved
+type recordsBackup struct {
+	lastEvents []ResponseDataPoint
+	minutes    map[string]DBDataPoint
+	hours      map[string]DBDataPoint
+	days       map[string]DBDataPoint
+	weeks      map[string]DBDataPoint
+	months     map[string]DBDataPoint
+	years      map[string]DBDataPoint
+}
+
+func copyRecords(records map[string]DBDataPoint) map[string]DBDataPoint {
+	c := map[string]DBDataPoint{}
+	for key, row := range records {
+		c[key] = row
+	}
+	return c
+}
+
+func (s *Server) backupRecords() recordsBackup {
+	lastEvents := make([]ResponseDataPoint, len(s.lastEvents))
+	copy(lastEvents, s.lastEvents)
+
+	return recordsBackup{
+		lastEvents: lastEvents,
+		minutes:    copyRecords(s.minutes),
+		hours:      copyRecords(s.hours),
+		days:       copyRecords(s.days),
+		weeks:      copyRecords(s.weeks),
+		months:     copyRecords(s.months),
+		years:      copyRecords(s.years),
+	}
+}
+
+func (s *Server) restoreRecords(b recordsBackup) {
+	s.lastEvents = b.lastEvents
+	s.minutes = b.minutes
+	s.hours = b.hours
+	s.days = b.days
+	s.weeks = b.weeks
+	s.months = b.months
+	s.years = b.years
+}
+
+func validDataPoint(udp godometer.UpdateDataPoint) bool {
+	for _, v := range []float32{udp.Meters, udp.MetersPerSecond, udp.KilometersPerHour} {
+		if math.IsNaN(float64(v)) || math.IsInf(float64(v), 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// Keys of the records changed by data points, to save them
+type changedRecords struct {
+	years   []string
+	months  []string
+	weeks   []string
+	days    []string
+	hours   []string
+	minutes []string
+	events  []string
+}
+
+// Add data points to the records in memory, returning what happened to each of them and
+// which records changed. The records of their periods need to be in memory already.
+func (s *Server) applyDataPoints(device string, updateDataPoints []godometer.UpdateDataPoint) ([]godometer.UpdateResult, changedRecords) {
+	results := []godometer.UpdateResult{}
+	changed := changedRecords{}
+
+	for _, udp := range updateDataPoints {
+		// Ignore already processed events, e.g. sent again as the response got lost
+		old, reported := s.reportedDataPoint(device, udp.Timestamp)
+		if reported && old.Meters == udp.Meters && old.MetersPerSecond == udp.MetersPerSecond && old.KilometersPerHour == udp.KilometersPerHour {
+			results = append(results, godometer.UpdateResult{Key: udp.Timestamp, Status: godometer.UpdateDuplicate})
+			continue
+		}
+
+		if !validDataPoint(udp) {
+			logger.Warn("Invalid values in data point", zap.String("timestamp", udp.Timestamp))
+			results = append(results, godometer.UpdateResult{Key: udp.Timestamp, Status: godometer.UpdateRejected, Reason: "invalid values"})
 			continue
 		}
 
@@ -448,6 +815,7 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 		ts, err := time.Parse(minuteLayout, udp.Timestamp)
 		if err != nil {
 			logger.Warn("Failed to parse time", zap.String("timestamp", udp.Timestamp), zap.Error(err))
+			results = append(results, godometer.UpdateResult{Key: udp.Timestamp, Status: godometer.UpdateRejected, Reason: "invalid timestamp"})
 			continue
 		}
 
@@ -463,40 +831,59 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 		weekRow, weeksOk := s.weeks[week]
 		dayRow, daysOk := s.days[day]
 		hourRow, hoursOk := s.hours[hour]
-		_, minutesOk := s.minutes[minute]
+		minuteRow, minutesOk := s.minutes[minute]
+		devices := setDeviceDataPoint(minuteRow.Devices, device, currentDataPoint)
+
+		// The monitor sends a minute again when it changes, e.g. pulses arriving late or
+		// the rest of a minute saved before a restart. What it sent before is replaced.
+		if reported {
+			yearRow = removeUpdate(yearRow, old)
+			monthRow = removeUpdate(monthRow, old)
+			weekRow = removeUpdate(weekRow, old)
+			dayRow = removeUpdate(dayRow, old)
+			hourRow = removeUpdate(hourRow, old)
+			minuteRow = removeUpdate(minuteRow, old)
+		}
 
 		yearRow, saveYear := calculateUpdate(yearRow, yearsOk, currentDataPoint)
 		monthRow, saveMonth := calculateUpdate(monthRow, monthsOk, currentDataPoint)
 		weekRow, saveWeek := calculateUpdate(weekRow, weeksOk, currentDataPoint)
 		dayRow, saveDay := calculateUpdate(dayRow, daysOk, currentDataPoint)
 		hourRow, saveHour := calculateUpdate(hourRow, hoursOk, currentDataPoint)
+		// Several devices can report the same minute
+		minuteRow, _ = calculateUpdate(minuteRow, minutesOk, currentDataPoint)
+		minuteRow.Devices = devices
+		// Empty minutes aren't saved, they don't change any totals even if sent again
 		saveMinute := false
 		if currentDataPoint.Meters > 0 || currentDataPoint.MetersPerSecond > 0 || currentDataPoint.KilometersPerHour > 0 || minutesOk {
 			saveMinute = true
 		}
+		if reported {
+			saveYear, saveMonth, saveWeek, saveDay, saveHour = true, true, true, true, true
+		}
 
-		if saveYear && !stringInList(years, year) {
-			years = append(years, year)
+		if saveYear && !stringInList(changed.years, year) {
+			changed.years = append(changed.years, year)
 		}
 
-		if saveMonth && !stringInList(months, month) {
-			months = append(months, month)
+		if saveMonth && !stringInList(changed.months, month) {
+			changed.months = append(changed.months, month)
 		}
 
-		if saveWeek && !stringInList(weeks, week) {
-			weeks = append(weeks, week)
+		if saveWeek && !stringInList(changed.weeks, week) {
+			changed.weeks = append(changed.weeks, week)
 		}
 
-		if saveDay && !stringInList(days, day) {
-			days = append(days, day)
+		if saveDay && !stringInList(changed.days, day) {
+			changed.days = append(changed.days, day)
 		}
 
-		if saveHour && !stringInList(hours, hour) {
-			hours = append(hours, hour)
+		if saveHour && !stringInList(changed.hours, hour) {
+			changed.hours = append(changed.hours, hour)
 		}
 
-		if saveMinute && !stringInList(minutes, minute) {
-			minutes = append(minutes, minute)
+		if saveMinute && !stringInList(changed.minutes, minute) {
+			changed.minutes = append(changed.minutes, minute)
 		}
 
 		s.years[year] = yearRow
@@ -504,15 +891,27 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 		s.weeks[week] = weekRow
 		s.days[day] = dayRow
 		s.hours[hour] = hourRow
-		s.minutes[minute] = currentDataPoint
+		s.minutes[minute] = minuteRow
 
-		s.lastEvents = append(s.lastEvents, currentDataPoint.toResponseDataPoint(udp.Timestamp))
-		newDataPoints += 1
-		newEvents = append(newEvents, udp.Timestamp)
+		event := currentDataPoint.toResponseDataPoint(udp.Timestamp)
+		event.Device = device
+		s.replaceLastEvent(event)
+		changed.events = append(changed.events, udp.Timestamp)
+		results = append(results, godometer.UpdateResult{Key: udp.Timestamp, Status: godometer.UpdateAccepted})
 	}
 
 	s.cleanLastEvents()
 
+	return results, changed
+}
+
+// Returns what happened to each data point, on errors nothing is saved
+func (s *Server) writeStats(ctx context.Context, device string, updateDataPoints []godometer.UpdateDataPoint) ([]godometer.UpdateResult, error) {
+	backup := s.backupRecords()
+	s.readMissingRecords(ctx, updateDataPoints)
+
+	results, changed := s.applyDataPoints(device, updateDataPoints)
+
 	db := GetClient(ctx, s.projectId)
 	batch := db.Batch()
 
@@ -526,7 +925,7 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 
 	batchRecords := 0
 
-	if newDataPoints > 0 {
+	if len(changed.events) > 0 {
 		batchRecords += 1
 		eventContainer := LastEventContainer{
 			Events: s.lastEvents,
@@ -534,37 +933,37 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 		batch.Set(eventsColl.Doc("lastEvents"), eventContainer)
 	}
 
-	for _, id := range years {
+	for _, id := range changed.years {
 		batchRecords += 1
 		ref := yearsColl.Doc(id)
 		batch.Set(ref, s.years[id])
 	}
 
-	for _, id := range months {
+	for _, id := range changed.months {
 		batchRecords += 1
 		ref := monthsColl.Doc(id)
 		batch.Set(ref, s.months[id])
 	}
 
-	for _, id := range weeks {
+	for _, id := range changed.weeks {
 		batchRecords += 1
 		ref := weeksColl.Doc(id)
 		batch.Set(ref, s.weeks[id])
 	}
 
-	for _, id := range days {
+	for _, id := range changed.days {
 		batchRecords += 1
 		ref := daysColl.Doc(id)
 		batch.Set(ref, s.days[id])
 	}
 
-	for _, id := range hours {
+	for _, id := range changed.hours {
 		batchRecords += 1
 		ref := hoursColl.Doc(id)
 		batch.Set(ref, s.hours[id])
 	}
 
-	for _, id := range minutes {
+	for _, id := range changed.minutes {
 		batchRecords += 1
 		ref := minutesColl.Doc(id)
 		batch.Set(ref, s.minutes[id])
@@ -572,17 +971,19 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 
 	if batchRecords > 0 {
 		var keys []string
-		keys = append(keys, years...)
-		keys = append(keys, months...)
-		keys = append(keys, weeks...)
-		keys = append(keys, days...)
-		keys = append(keys, hours...)
-		keys = append(keys, minutes...)
-		logger.Info("Processed events", zap.Strings("events", newEvents))
+		keys = append(keys, changed.years...)
+		keys = append(keys, changed.months...)
+		keys = append(keys, changed.weeks...)
+		keys = append(keys, changed.days...)
+		keys = append(keys, changed.hours...)
+		keys = append(keys, changed.minutes...)
+		logger.Info("Processed events", zap.Strings("events", changed.events))
 		logger.Info("Saving records to DB", zap.Int("count", batchRecords), zap.Strings("keys", keys))
 		_, err := batch.Commit(ctx)
 		if err != nil {
 			logger.Warn("Error trying to save records to DB", zap.Error(err))
+			s.restoreRecords(backup)
+			return results, fmt.Errorf("could not save records: %s", err)
 		}
 	} else {
 		logger.Info("How strange, no records updated")
@@ -593,6 +994,174 @@ func (s *Server) writeStats(ctx context.Context, updateDataPoints []godometer.Up
 	if debugDb {
 		s.printLatestRecords()
 	}
+
+	return results, nil
+}
+
+func (s *Server) isKnownSession(device string, session godometer.UpdateSession) bool {
+	for _, rs := range s.lastSessions {
+		if rs.Device == device && rs.Start == session.Start {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns what happened to each session, on errors nothing is saved
+func (s *Server) writeSessions(ctx context.Context, device string, sessions []godometer.UpdateSession) ([]godometer.UpdateResult, error) {
+	results := []godometer.UpdateResult{}
+	var newSessions []ResponseSession
+	for _, us := range sessions {
+		// Already saved, e.g. sent again as the response got lost
+		if s.isKnownSession(device, us) {
+			results = append(results, godometer.UpdateResult{Key: us.Start, Status: godometer.UpdateDuplicate})
+			continue
+		}
+
+		if _, err := time.Parse(time.RFC3339, us.Start); err != nil {
+			logger.Warn("Failed to parse session start", zap.String("start", us.Start), zap.Error(err))
+			results = append(results, godometer.UpdateResult{Key: us.Start, Status: godometer.UpdateRejected, Reason: "invalid start"})
+			continue
+		}
+
+		newSessions = append(newSessions, ResponseSession{
+			Device:               device,
+			Start:                us.Start,
+			End:                  us.End,
+			MovingSeconds:        us.MovingSeconds,
+			Meters:               us.Meters,
+			MetersPerSecond:      us.MetersPerSecond,
+			KilometersPerHour:    us.KilometersPerHour,
+			MaxMetersPerSecond:   us.MaxMetersPerSecond,
+			MaxKilometersPerHour: us.MaxKilometersPerHour,
+		})
+		results = append(results, godometer.UpdateResult{Key: us.Start, Status: godometer.UpdateAccepted})
+	}
+
+	if len(newSessions) == 0 {
+		return results, nil
+	}
+
+	lastSessions := append([]ResponseSession{}, s.lastSessions...)
+	lastSessions = append(lastSessions, newSessions...)
+	sort.Slice(lastSessions, func(i, j int) bool {
+		return lastSessions[i].Start < lastSessions[j].Start
+	})
+
+	keep := 0
+	if len(lastSessions) > keepLastSessions {
+		keep = len(lastSessions) - keepLastSessions
+	}
+	lastSessions = lastSessions[keep:]
+
+	db := GetClient(ctx, s.projectId)
+	batch := db.Batch()
+	sessionsColl := db.Collection(collectionName("sessions"))
+
+	// Every session is kept in the DB, the container only has the latest ones
+	var keys []string
+	for _, rs := range newSessions {
+		key := rs.Start
+		if rs.Device != "" {
+			key = rs.Device + " " + rs.Start
+		}
+		batch.Set(sessionsColl.Doc(key), rs)
+		keys = append(keys, key)
+	}
+
+	batch.Set(sessionsColl.Doc("lastSessions"), LastSessionContainer{
+		Sessions: lastSessions,
+	})
+
+	logger.Info("Saving sessions to DB", zap.Strings("sessions", keys))
+	_, err := batch.Commit(ctx)
+	if err != nil {
+		logger.Warn("Error trying to save sessions to DB", zap.Error(err))
+		return results, fmt.Errorf("could not save sessions: %s", err)
+	}
+
+	s.lastSessions = lastSessions
+	return results, nil
+}
+
+// Returns what happened to each sample, on errors nothing is saved
+func (s *Server) writeSamples(ctx context.Context, device string, samples []godometer.UpdateSample) ([]godometer.UpdateResult, error) {
+	results := []godometer.UpdateResult{}
+
+	// Minute -> key -> sample, only the ones that changed
+	updates := map[string]map[string]interface{}{}
+	var keys []string
+
+	for _, us := range samples {
+		ts, err := time.Parse(godometer.APISampleTimeLayout, us.Timestamp)
+		if err != nil {
+			logger.Warn("Failed to parse sample time", zap.String("timestamp", us.Timestamp), zap.Error(err))
+			results = append(results, godometer.UpdateResult{Key: us.Timestamp, Status: godometer.UpdateRejected, Reason: "invalid timestamp"})
+			continue
+		}
+
+		sample := ResponseSample{
+			Device:            device,
+			Timestamp:         us.Timestamp,
+			Seconds:           us.Seconds,
+			Meters:            us.Meters,
+			MetersPerSecond:   us.MetersPerSecond,
+			KilometersPerHour: us.KilometersPerHour,
+		}
+
+		minute := ts.Format(minuteLayout)
+		key := sampleKey(device, us.Timestamp)
+
+		// Already saved, e.g. sent again as the response got lost
+		if old, ok := s.samples[minute].Samples[key]; ok && old == sample {
+			results = append(results, godometer.UpdateResult{Key: us.Timestamp, Status: godometer.UpdateDuplicate})
+			continue
+		}
+
+		if _, ok := updates[minute]; !ok {
+			updates[minute] = map[string]interface{}{}
+		}
+		updates[minute][key] = sample
+		keys = append(keys, key)
+		results = append(results, godometer.UpdateResult{Key: us.Timestamp, Status: godometer.UpdateAccepted})
+	}
+
+	if len(updates) == 0 {
+		return results, nil
+	}
+
+	db := GetClient(ctx, s.projectId)
+	batch := db.Batch()
+	samplesColl := db.Collection(collectionName("samples"))
+
+	// Merge so samples of the same minute from other updates and devices are kept
+	for minute, update := range updates {
+		batch.Set(samplesColl.Doc(minute), map[string]interface{}{"samples": update}, firestore.MergeAll)
+	}
+
+	logger.Info("Saving samples to DB", zap.Strings("samples", keys))
+	_, err := batch.Commit(ctx)
+	if err != nil {
+		logger.Warn("Error trying to save samples to DB", zap.Error(err))
+		return results, fmt.Errorf("could not save samples: %s", err)
+	}
+
+	// Keep the saved samples in memory too
+	for minute, update := range updates {
+		container, ok := s.samples[minute]
+		if !ok || container.Samples == nil {
+			container = SampleContainer{Samples: map[string]ResponseSample{}}
+			s.samples[minute] = container
+		}
+
+		for key, sample := range update {
+			container.Samples[key] = sample.(ResponseSample)
+		}
+	}
+
+	s.clearOldStats()
+	return results, nil
 }
 
 var firestoreClient *firestore.Client
@@ -768,12 +1337,14 @@ func (s *Server) fillFakeDataRecords(records map[string]DBDataPoint) {
 
 func (s *Server) generateFakeData() {
 	// Initialize all data structures
+	s.recordsMutex.Lock()
 	s.fillFakeDataRecords(s.years)
 	s.fillFakeDataRecords(s.months)
 	s.fillFakeDataRecords(s.weeks)
 	s.fillFakeDataRecords(s.days)
 	s.fillFakeDataRecords(s.hours)
 	s.fillFakeDataRecords(s.minutes)
+	s.recordsMutex.Unlock()
 
 	logger.Info("Filled records with fake data")
 
@@ -793,7 +1364,11 @@ func (s *Server) generateFakeData() {
 			}
 
 			logger.Info("FAKED EVENT", zap.Float32("meters", udp[0].Meters), zap.Float32("MPS", udp[0].MetersPerSecond), zap.Float32("KPH", udp[0].KilometersPerHour))
-			s.writeStats(ctx, udp)
+			s.recordsMutex.Lock()
+			if _, err := s.writeStats(ctx, "", udp); err != nil {
+				logger.Warn("Failed to save fake data", zap.Error(err))
+			}
+			s.recordsMutex.Unlock()
 		}
 	}
 }
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	pb "google.golang.org/genproto/googleapis/firestore/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Just enough of Firestore in memory for the server, the real client talks to it like
+// to the emulator
+type fakeFirestore struct {
+	pb.UnimplementedFirestoreServer
+	mutex *sync.Mutex
+	docs  map[string]*pb.Document
+	// Commits writing to this collection fail
+	failCollection string
+}
+
+func (f *fakeFirestore) BatchGetDocuments(req *pb.BatchGetDocumentsRequest, stream pb.Firestore_BatchGetDocumentsServer) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, name := range req.Documents {
+		resp := &pb.BatchGetDocumentsResponse{ReadTime: ptypes.TimestampNow()}
+		if doc, ok := f.docs[name]; ok {
+			resp.Result = &pb.BatchGetDocumentsResponse_Found{Found: doc}
+		} else {
+			resp.Result = &pb.BatchGetDocumentsResponse_Missing{Missing: name}
+		}
+
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fakeFirestore) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, w := range req.Writes {
+		if w.GetUpdate() == nil {
+			return nil, status.Error(codes.Unimplemented, "only updates are supported")
+		}
+		if f.failCollection != "" && strings.Contains(w.GetUpdate().Name, "/"+f.failCollection+"/") {
+			return nil, status.Error(codes.Internal, "failing on purpose")
+		}
+	}
+
+	now := ptypes.TimestampNow()
+	resp := &pb.CommitResponse{CommitTime: now}
+	for _, w := range req.Writes {
+		update := w.GetUpdate()
+		doc := &pb.Document{Name: update.Name, Fields: update.Fields, CreateTime: now, UpdateTime: now}
+		if old, ok := f.docs[update.Name]; ok && w.GetUpdateMask() != nil {
+			doc.Fields = mergeFields(old.Fields, update.Fields)
+			doc.CreateTime = old.CreateTime
+		}
+
+		f.docs[update.Name] = doc
+		resp.WriteResults = append(resp.WriteResults, &pb.WriteResult{UpdateTime: now})
+	}
+
+	return resp, nil
+}
+
+func mergeFields(old map[string]*pb.Value, update map[string]*pb.Value) map[string]*pb.Value {
+	merged := map[string]*pb.Value{}
+	for key, value := range old {
+		merged[key] = value
+	}
+
+	for key, value := range update {
+		if o, ok := merged[key]; ok && o.GetMapValue() != nil && value.GetMapValue() != nil {
+			value = &pb.Value{ValueType: &pb.Value_MapValue{MapValue: &pb.MapValue{
+				Fields: mergeFields(o.GetMapValue().Fields, value.GetMapValue().Fields),
+			}}}
+		}
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func (f *fakeFirestore) setFailCollection(collection string) {
+	f.mutex.Lock()
+	f.failCollection = collection
+	f.mutex.Unlock()
+}
+
+// Serve a fake Firestore for GetClient
+func startFakeFirestore(t *testing.T) *fakeFirestore {
+	f := &fakeFirestore{}
+	f.mutex = &sync.Mutex{}
+	f.docs = map[string]*pb.Document{}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := grpc.NewServer()
+	pb.RegisterFirestoreServer(srv, f)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+
+	previous, hadPrevious := os.LookupEnv("FIRESTORE_EMULATOR_HOST")
+	_ = os.Setenv("FIRESTORE_EMULATOR_HOST", lis.Addr().String())
+	firestoreClient = nil
+
+	t.Cleanup(func() {
+		if firestoreClient != nil {
+			_ = firestoreClient.Close()
+			firestoreClient = nil
+		}
+		srv.Stop()
+
+		if hadPrevious {
+			_ = os.Setenv("FIRESTORE_EMULATOR_HOST", previous)
+		} else {
+			_ = os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+		}
+	})
+
+	return f
+}
+
+// A server with its real router, the frontend files are looked up relative to the working directory
+func newTestServer(t *testing.T, apiAuth string) *Server {
+	dir, err := ioutil.TempDir("", "godoserv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public := filepath.Join(dir, "frontend", "public")
+	cwd := filepath.Join(dir, "cmd", "godoserv")
+	for _, path := range []string{public, cwd} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(public, "index.html"), []byte("<html></html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(cwd); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(previous)
+	}()
+
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	return NewServer(true, "godometer-test", apiAuth)
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lietu/godometer/monitor"
+)
+
+const testApiAuth = "secret"
+
+// Serves the real router, losing the response to the first update after the server handled
+// it, like when the connection drops after the server saved everything
+func newLossyTestServer(s *Server) *httptest.Server {
+	updates := 0
+	mutex := &sync.Mutex{}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/updateStats" {
+			s.engine.ServeHTTP(w, r)
+			return
+		}
+
+		mutex.Lock()
+		updates++
+		lose := updates == 1
+		mutex.Unlock()
+
+		if !lose {
+			s.engine.ServeHTTP(w, r)
+			return
+		}
+
+		s.engine.ServeHTTP(httptest.NewRecorder(), r)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+}
+
+func newTestReporter(t *testing.T, url string) *monitor.OutboxReporter {
+	dir, err := ioutil.TempDir("", "godometer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+
+	return monitor.NewGodoservReporter(filepath.Join(dir, "godometer.txt"), url, testApiAuth)
+}
+
+// Reads the saved record, the server only keeps recent ones in memory
+func readSavedRecord(t *testing.T, s *Server, period string, id string) DBDataPoint {
+	ctx := context.Background()
+	doc, err := GetClient(ctx, s.projectId).Collection(collectionName(period)).Doc(id).Get(ctx)
+	if err != nil {
+		t.Fatalf("failed to read %s %s: %s", period, id, err)
+	}
+
+	record := DBDataPoint{}
+	if err := doc.DataTo(&record); err != nil {
+		t.Fatalf("failed to parse %s %s: %s", period, id, err)
+	}
+
+	return record
+}
+
+func TestResendSameBatch(t *testing.T) {
+	startFakeFirestore(t)
+	s := newTestServer(t, testApiAuth)
+	ts := newLossyTestServer(s)
+	defer ts.Close()
+
+	// A full batch, far more than the latest events the server keeps
+	start := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	var dataPoints []monitor.FileDataPoint
+	for i := 0; i < 60; i++ {
+		dataPoints = append(dataPoints, monitor.FileDataPoint{
+			Timestamp:         start.Add(time.Duration(i) * time.Minute).Format(minuteLayout),
+			Meters:            10,
+			MetersPerSecond:   1,
+			KilometersPerHour: 3.6,
+		})
+	}
+
+	reporter := newTestReporter(t, ts.URL)
+	if err := reporter.Report("", monitor.StatsReport{DataPoints: dataPoints}); err == nil {
+		t.Fatalf("expected the lost response to fail the first report")
+	}
+	if reporter.Waiting() != len(dataPoints) {
+		t.Fatalf("expected %d data points waiting, got %d", len(dataPoints), reporter.Waiting())
+	}
+
+	// Sends the same batch again
+	if err := reporter.Report("", monitor.StatsReport{}); err != nil {
+		t.Fatalf("resending failed: %s", err)
+	}
+	if reporter.Waiting() != 0 {
+		t.Fatalf("expected nothing waiting, got %d", reporter.Waiting())
+	}
+
+	day := readSavedRecord(t, s, "days", start.Format(dayLayout))
+	if day.Meters != 600 || day.Counter != 60 {
+		t.Errorf("expected 600 meters from 60 data points, got %v from %d", day.Meters, day.Counter)
+	}
+
+	minute := readSavedRecord(t, s, "minutes", start.Format(minuteLayout))
+	if minute.Meters != 10 || minute.Counter != 1 {
+		t.Errorf("expected 10 meters in the first minute, got %v from %d", minute.Meters, minute.Counter)
+	}
+}
+
+func TestResendChangedMinute(t *testing.T) {
+	startFakeFirestore(t)
+	s := newTestServer(t, testApiAuth)
+	ts := httptest.NewServer(s.engine)
+	defer ts.Close()
+
+	start := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	first := monitor.FileDataPoint{Timestamp: start.Format(minuteLayout), Meters: 10, MetersPerSecond: 1, KilometersPerHour: 3.6}
+	second := monitor.FileDataPoint{Timestamp: start.Add(time.Minute).Format(minuteLayout), Meters: 5, MetersPerSecond: 2, KilometersPerHour: 7.2}
+
+	reporter := newTestReporter(t, ts.URL)
+	if err := reporter.Report("", monitor.StatsReport{DataPoints: []monitor.FileDataPoint{first, second}}); err != nil {
+		t.Fatalf("reporting failed: %s", err)
+	}
+
+	// The minute kept going after it was sent
+	first.Meters = 25
+	first.MetersPerSecond = 3
+	first.KilometersPerHour = 10.8
+	if err := reporter.Report("", monitor.StatsReport{DataPoints: []monitor.FileDataPoint{first}}); err != nil {
+		t.Fatalf("reporting the changed minute failed: %s", err)
+	}
+
+	check := func(s *Server) {
+		t.Helper()
+
+		day := readSavedRecord(t, s, "days", start.Format(dayLayout))
+		if day.Meters != 30 || day.Counter != 2 || day.MetersPerSecond != 2.5 {
+			t.Errorf("expected 30 meters at 2.5m/s from 2 data points, got %v at %vm/s from %d", day.Meters, day.MetersPerSecond, day.Counter)
+		}
+
+		minute := readSavedRecord(t, s, "minutes", start.Format(minuteLayout))
+		if minute.Meters != 25 || minute.Counter != 1 {
+			t.Errorf("expected 25 meters in the first minute, got %v from %d", minute.Meters, minute.Counter)
+		}
+	}
+	check(s)
+
+	// After a restart the same values are still a duplicate
+	restarted := newTestServer(t, testApiAuth)
+	rts := httptest.NewServer(restarted.engine)
+	defer rts.Close()
+
+	reporter = newTestReporter(t, rts.URL)
+	if err := reporter.Report("", monitor.StatsReport{DataPoints: []monitor.FileDataPoint{first}}); err != nil {
+		t.Fatalf("reporting after the restart failed: %s", err)
+	}
+	check(restarted)
+}
+
+func TestResendAfterFailedSave(t *testing.T) {
+	db := startFakeFirestore(t)
+	s := newTestServer(t, testApiAuth)
+	ts := httptest.NewServer(s.engine)
+	defer ts.Close()
+
+	start := time.Date(2020, 5, 4, 10, 0, 0, 0, time.UTC)
+	report := monitor.StatsReport{
+		DataPoints: []monitor.FileDataPoint{
+			{Timestamp: start.Format(minuteLayout), Meters: 10, MetersPerSecond: 1, KilometersPerHour: 3.6},
+		},
+		Sessions: []monitor.FileSession{
+			{Start: start.Format(time.RFC3339), End: start.Add(time.Minute).Format(time.RFC3339), MovingSeconds: 60, Meters: 10},
+		},
+	}
+
+	// The data points are saved, the session is not
+	db.setFailCollection(collectionName("sessions"))
+	reporter := newTestReporter(t, ts.URL)
+	if err := reporter.Report("", report); err == nil {
+		t.Fatalf("expected the failed save to fail the report")
+	}
+	if reporter.Waiting() != 2 {
+		t.Fatalf("expected everything waiting, got %d", reporter.Waiting())
+	}
+
+	db.setFailCollection("")
+	if err := reporter.Report("", monitor.StatsReport{}); err != nil {
+		t.Fatalf("resending failed: %s", err)
+	}
+	if reporter.Waiting() != 0 {
+		t.Fatalf("expected nothing waiting, got %d", reporter.Waiting())
+	}
+
+	day := readSavedRecord(t, s, "days", start.Format(dayLayout))
+	if day.Meters != 10 || day.Counter != 1 {
+		t.Errorf("expected 10 meters from 1 data point, got %v from %d", day.Meters, day.Counter)
+	}
+}